@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"log"
+	"math"
+)
+
+// defaultMaxAnimationPixels caps the pixels of all of a GIF's frames put
+// together, about 400MB once composited.
+const defaultMaxAnimationPixels = 100_000_000
+
+// animation is a decoded animated image with every frame fully composited,
+// so each one can be processed as a standalone still.
+type animation struct {
+	Frames    []*image.RGBA
+	Delays    []int // in 100ths of a second, like GIF
+	LoopCount int
+}
+
+func isGIF(imgData []byte) bool {
+	return bytes.HasPrefix(imgData, []byte("GIF87a")) || bytes.HasPrefix(imgData, []byte("GIF89a"))
+}
+
+// decodeAnimation decodes every frame of a GIF, applying each frame's
+// disposal method so partial frames come out complete. Like decodeImage, it
+// turns decoder panics into errors.
+func decodeAnimation(imgData []byte) (anim *animation, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Recovered from panic while decoding GIF: %v", r)
+			anim, err = nil, fmt.Errorf("the GIF is malformed")
+		}
+	}()
+
+	budget := int64(config.Image.MaxAnimationPixels)
+	if budget <= 0 {
+		budget = defaultMaxAnimationPixels
+	}
+
+	// Every frame is composited onto a full canvas, so what counts is the
+	// canvas size times the frame count. The canvas alone is checked before
+	// decoding anything, the frames once they're known.
+	cfg, err := gif.DecodeConfig(bytes.NewReader(imgData))
+	if err != nil {
+		return nil, fmt.Errorf("GIF decoding failed: %w", err)
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > budget {
+		return nil, fmt.Errorf("that GIF is %dx%d, which is too big for me", cfg.Width, cfg.Height)
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(imgData))
+	if err != nil {
+		return nil, fmt.Errorf("GIF decoding failed: %w", err)
+	}
+
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() && len(g.Image) > 0 {
+		bounds = g.Image[0].Bounds()
+	}
+	if int64(bounds.Dx())*int64(bounds.Dy())*int64(len(g.Image)) > budget {
+		return nil, fmt.Errorf("that GIF has %d frames of %dx%d, which is more than I can handle", len(g.Image), bounds.Dx(), bounds.Dy())
+	}
+
+	anim = &animation{LoopCount: g.LoopCount}
+	canvas := image.NewRGBA(bounds)
+
+	for i, frame := range g.Image {
+		var previous *image.RGBA
+		if i < len(g.Disposal) && g.Disposal[i] == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		anim.Frames = append(anim.Frames, cloneRGBA(canvas))
+		anim.Delays = append(anim.Delays, g.Delay[i])
+
+		if i < len(g.Disposal) {
+			switch g.Disposal[i] {
+			case gif.DisposalBackground:
+				draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+			case gif.DisposalPrevious:
+				canvas = previous
+			}
+		}
+	}
+
+	return anim, nil
+}
+
+// limitFrameRate enforces max_frame_rate on anim, either slowing frames
+// that are too quick down to it or refusing the animation. It returns a note
+// for the reply if anything was changed.
+func limitFrameRate(anim *animation) (string, error) {
+	maxRate := config.Image.MaxFrameRate
+	if maxRate <= 0 {
+		return "", nil
+	}
+	minDelay := int(math.Ceil(100 / maxRate))
+
+	tooFast := 0
+	for _, delay := range anim.Delays {
+		if delay < minDelay {
+			tooFast++
+		}
+	}
+	if tooFast == 0 {
+		return "", nil
+	}
+
+	if config.Image.FrameRateAction == "reject" {
+		return "", fmt.Errorf("this GIF runs faster than %g frames per second, which is more than I can handle", maxRate)
+	}
+	for i, delay := range anim.Delays {
+		anim.Delays[i] = max(delay, minDelay)
+	}
+	return fmt.Sprintf("Slowed down to %g frames per second.", 100/float64(minDelay)), nil
+}
+
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	clone := image.NewRGBA(img.Bounds())
+	copy(clone.Pix, img.Pix)
+	return clone
+}
+
+// crunchAnimation runs every frame through the same crop, effects and JPEG
+// round trip as a still image, then reassembles them into a GIF.
+func crunchAnimation(anim *animation, opts options) (result, error) {
+	out := &gif.GIF{LoopCount: anim.LoopCount}
+
+	frames := anim.Frames
+	if opts.Datamosh {
+		frames = datamosh(frames)
+	}
+
+	for i, frame := range frames {
+		img, err := prepareImage(frame, opts)
+		if err != nil {
+			return result{}, err
+		}
+
+		crunched, err := crunchFrame(img, opts.quality())
+		if err != nil {
+			return result{}, fmt.Errorf("frame %d: %w", i+1, err)
+		}
+
+		out.Image = append(out.Image, crunched)
+		out.Delay = append(out.Delay, anim.Delays[i])
+		out.Disposal = append(out.Disposal, gif.DisposalNone)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, out); err != nil {
+		return result{}, fmt.Errorf("error encoding gif: %w", err)
+	}
+	return result{Data: buf.Bytes(), Format: "gif"}, nil
+}
+
+// crunchFrame gives a frame JPEG artifacts and then squeezes it back into a
+// GIF palette.
+func crunchFrame(img image.Image, quality int) (*image.Paletted, error) {
+	crunched, err := crunchAt(img, quality)
+	if err != nil {
+		return nil, err
+	}
+
+	return toPaletted(crunched), nil
+}
+
+func toPaletted(img image.Image) *image.Paletted {
+	paletted := image.NewPaletted(img.Bounds(), palette.Plan9)
+	draw.FloydSteinberg.Draw(paletted, img.Bounds(), img, img.Bounds().Min)
+	return paletted
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"strings"
+	"testing"
+)
+
+var frameColors = []color.RGBA{
+	{255, 0, 0, 255},
+	{0, 255, 0, 255},
+	{0, 0, 255, 255},
+}
+
+// makeGIF encodes an animation with a flat frame of each colour, each shown
+// for delay hundredths of a second.
+func makeGIF(t *testing.T, w, h int, colors []color.RGBA, delay int) []byte {
+	t.Helper()
+	g := &gif.GIF{}
+	for _, c := range colors {
+		frame := image.NewPaletted(image.Rect(0, 0, w, h), palette.Plan9)
+		index := uint8(color.Palette(palette.Plan9).Index(c))
+		for i := range frame.Pix {
+			frame.Pix[i] = index
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, delay)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeSelectedFrame(t *testing.T) {
+	data := makeGIF(t, 8, 8, frameColors, 10)
+
+	img, anim, format, err := decodeInput(data, options{Frame: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if anim != nil || format != "gif" {
+		t.Fatalf("got an animation (%v) or format %q, want a single gif frame", anim != nil, format)
+	}
+	if !sameColor(img.At(4, 4), frameColors[1]) {
+		t.Errorf("frame 2 is %v, want %v", img.At(4, 4), frameColors[1])
+	}
+
+	if _, anim, _, err := decodeInput(data, options{}); err != nil || anim == nil || len(anim.Frames) != 3 {
+		t.Errorf("without a frame, got %v frames, %v; want the whole animation", anim, err)
+	}
+
+	if _, _, _, err := decodeInput(data, options{Frame: 4}); err == nil || !strings.Contains(err.Error(), "only has 3 frames") {
+		t.Errorf("frame 4 of 3 gave %v", err)
+	}
+	if _, _, _, err := decodeInput(encodePNG(t, testImage(8, 8)), options{Frame: 1}); err == nil {
+		t.Error("asking for a frame of a PNG didn't fail")
+	}
+}
+
+func TestFrameRateLimit(t *testing.T) {
+	// Two hundredths of a second a frame is 50 frames per second.
+	data := makeGIF(t, 8, 8, frameColors, 2)
+
+	withConfig(t, func(c *Config) {
+		c.Image.MaxFrameRate = 20
+		c.Image.FrameRateAction = "retime"
+	})
+	d, err := decodeStage(data, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, delay := range d.anim.Delays {
+		if delay != 5 {
+			t.Errorf("frame %d has a delay of %d, want 5", i+1, delay)
+		}
+	}
+	if !strings.Contains(d.note, "20 frames per second") {
+		t.Errorf("note %q doesn't say it was slowed down", d.note)
+	}
+
+	withConfig(t, func(c *Config) { c.Image.FrameRateAction = "reject" })
+	if _, err := decodeStage(data, options{}); err == nil || !strings.Contains(err.Error(), "faster than 20 frames per second") {
+		t.Errorf("rejecting a fast GIF gave %v", err)
+	}
+
+	// Slow enough GIFs are left alone.
+	d, err = decodeStage(makeGIF(t, 8, 8, frameColors, 10), options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.anim.Delays[0] != 10 || d.note != "" {
+		t.Errorf("a 10 fps GIF came out with delays %v and note %q", d.anim.Delays, d.note)
+	}
+}
+
+func TestDatamosh(t *testing.T) {
+	data := makeGIF(t, 32, 32, frameColors, 10)
+	crunchWith := func(content string) *gif.GIF {
+		t.Helper()
+		opts, err := parseOptions(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, anim, _, err := decodeInput(data, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := crunchAnimation(anim, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, err := gif.DecodeAll(bytes.NewReader(res.Data))
+		if err != nil {
+			t.Fatalf("%q output isn't a valid GIF: %v", content, err)
+		}
+		return g
+	}
+
+	plain, moshed := crunchWith("@bot quality 60"), crunchWith("@bot datamosh quality 60")
+	if len(moshed.Image) != 3 {
+		t.Fatalf("datamosh gave %d frames, want 3", len(moshed.Image))
+	}
+
+	// Nothing new is drawn after the first frame, so the red stays where
+	// the plain crunch turns blue.
+	r, _, b, _ := plain.Image[2].At(16, 16).RGBA()
+	if b <= r {
+		t.Errorf("plain crunch's last frame is %v, want it blue", plain.Image[2].At(16, 16))
+	}
+	r, _, b, _ = moshed.Image[2].At(16, 16).RGBA()
+	if r <= b {
+		t.Errorf("datamoshed last frame is %v, want the first frame's red dragged along", moshed.Image[2].At(16, 16))
+	}
+}
+
+func TestAnimationPixelBudget(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Image.MaxAnimationPixels = 10000 })
+
+	// 3 frames of 50x50 is 7500 pixels, 5 frames 12500.
+	if _, _, _, err := decodeInput(makeGIF(t, 50, 50, frameColors, 10), options{}); err != nil {
+		t.Errorf("GIF under the budget was refused: %v", err)
+	}
+	five := append(append([]color.RGBA(nil), frameColors...), frameColors[:2]...)
+	if _, _, _, err := decodeInput(makeGIF(t, 50, 50, five, 10), options{}); err == nil || !strings.Contains(err.Error(), "5 frames of 50x50") {
+		t.Errorf("GIF over the budget gave %v", err)
+	}
+
+	// A tiny frame on a huge canvas is refused before decoding the frames.
+	frame := image.NewPaletted(image.Rect(0, 0, 4, 4), palette.Plan9)
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, &gif.GIF{
+		Image:  []*image.Paletted{frame},
+		Delay:  []int{10},
+		Config: image.Config{Width: 200, Height: 200, ColorModel: color.Palette(palette.Plan9)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeAnimation(buf.Bytes()); err == nil || !strings.Contains(err.Error(), "200x200") {
+		t.Errorf("200x200 canvas gave %v", err)
+	}
+}
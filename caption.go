@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	maxCaptionLength = 200
+	maxCaptionLines  = 3
+	minCaptionSize   = 10
+)
+
+var captionFont = sync.OnceValues(func() (*opentype.Font, error) {
+	return opentype.Parse(gobold.TTF)
+})
+
+// captionText returns what follows the word "caption" in a status, with the
+// original capitalisation and punctuation that tokenizing throws away.
+func captionText(content string) string {
+	fields := strings.Fields(stripHTML(content))
+	for i, field := range fields {
+		if strings.ToLower(trimPunctuation(field)) != "caption" {
+			continue
+		}
+		var words []string
+		for _, word := range fields[i+1:] {
+			if !strings.HasPrefix(word, "@") {
+				words = append(words, word)
+			}
+		}
+		return strings.Join(words, " ")
+	}
+	return ""
+}
+
+// parseCaption splits caption text into the top and bottom lines of a meme:
+// "top text | bottom text". Without a "|" it all goes on top.
+func parseCaption(text string) (top, bottom string, err error) {
+	if text == "" {
+		return "", "", fmt.Errorf("caption needs some text, like \"caption hello | world\"")
+	}
+	if length(text) > maxCaptionLength {
+		return "", "", fmt.Errorf("captions can be at most %d characters", maxCaptionLength)
+	}
+	top, bottom, _ = strings.Cut(text, "|")
+	return strings.TrimSpace(top), strings.TrimSpace(bottom), nil
+}
+
+// drawCaption burns meme-style text onto a copy of img: white capitals with
+// a black outline, wrapped and shrunk until each caption fits in a third of
+// the image.
+func drawCaption(img image.Image, top, bottom string) (image.Image, error) {
+	f, err := captionFont()
+	if err != nil {
+		return nil, fmt.Errorf("error loading caption font: %w", err)
+	}
+
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(out, out.Bounds(), img, b.Min, draw.Src)
+
+	for _, caption := range []struct {
+		text string
+		top  bool
+	}{{top, true}, {bottom, false}} {
+		if caption.text == "" {
+			continue
+		}
+		if err := drawCaptionBlock(out, f, strings.ToUpper(caption.text), caption.top); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func drawCaptionBlock(dst *image.RGBA, f *opentype.Font, text string, atTop bool) error {
+	width, height := dst.Bounds().Dx(), dst.Bounds().Dy()
+	maxWidth := fixed.I(width * 95 / 100)
+
+	var face font.Face
+	var lines []string
+	for size := float64(height) / 8; ; size *= 0.85 {
+		size = max(size, minCaptionSize)
+		var err error
+		face, err = opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			return fmt.Errorf("error sizing caption font: %w", err)
+		}
+		lines = wrapText(face, text, maxWidth)
+		lineHeight := face.Metrics().Height.Ceil()
+		if size == minCaptionSize || (len(lines) <= maxCaptionLines && len(lines)*lineHeight <= height/3) {
+			break
+		}
+		face.Close()
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	lineHeight := metrics.Height.Ceil()
+	outline := max(1, lineHeight/16)
+	margin := lineHeight / 4
+
+	y := margin + metrics.Ascent.Ceil()
+	if !atTop {
+		y = height - margin - len(lines)*lineHeight + metrics.Ascent.Ceil()
+	}
+
+	for _, line := range lines {
+		x := (fixed.I(width) - font.MeasureString(face, line)) / 2
+		drawOutlined(dst, face, line, x, y, outline)
+		y += lineHeight
+	}
+	return nil
+}
+
+// drawOutlined draws white text with a black outline outline pixels thick,
+// with its baseline starting at (x, y).
+func drawOutlined(dst draw.Image, face font.Face, text string, x fixed.Int26_6, y, outline int) {
+	d := &font.Drawer{Dst: dst, Src: image.Black, Face: face}
+	for dy := -outline; dy <= outline; dy++ {
+		for dx := -outline; dx <= outline; dx++ {
+			if dx*dx+dy*dy > outline*outline {
+				continue
+			}
+			d.Dot = fixed.Point26_6{X: x + fixed.I(dx), Y: fixed.I(y + dy)}
+			d.DrawString(text)
+		}
+	}
+	d.Src = image.White
+	d.Dot = fixed.Point26_6{X: x, Y: fixed.I(y)}
+	d.DrawString(text)
+}
+
+// drawLabel burns a short label like "gen 3/8" into the bottom left corner
+// of a copy of img, small enough to stay out of the way.
+func drawLabel(img image.Image, label string) (image.Image, error) {
+	f, err := captionFont()
+	if err != nil {
+		return nil, fmt.Errorf("error loading caption font: %w", err)
+	}
+
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(out, out.Bounds(), img, b.Min, draw.Src)
+
+	size := max(float64(min(b.Dx(), b.Dy()))/14, minCaptionSize)
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, fmt.Errorf("error sizing caption font: %w", err)
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	margin := metrics.Height.Ceil() / 3
+	outline := max(1, metrics.Height.Ceil()/16)
+	drawOutlined(out, face, label, fixed.I(margin), b.Dy()-margin-metrics.Descent.Ceil(), outline)
+	return out, nil
+}
+
+// wrapText breaks text into lines no wider than maxWidth, breaking only
+// between words. A single word that's too wide gets a line to itself.
+func wrapText(face font.Face, text string, maxWidth fixed.Int26_6) []string {
+	var lines []string
+	var line string
+	for _, word := range strings.Fields(text) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if line != "" && font.MeasureString(face, candidate) > maxWidth {
+			lines = append(lines, line)
+			candidate = word
+		}
+		line = candidate
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
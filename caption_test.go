@@ -0,0 +1,53 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestCaptionGolden(t *testing.T) {
+	opts, err := parseOptions("@bot quality 60 caption Hello | World")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.CaptionTop != "Hello" || opts.CaptionBottom != "World" {
+		t.Fatalf("parsed caption %q | %q, want Hello | World", opts.CaptionTop, opts.CaptionBottom)
+	}
+	out, err := drawCaption(flatColor(96, 64, color.RGBA{40, 90, 160, 255}), opts.CaptionTop, opts.CaptionBottom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "caption", out)
+}
+
+func TestCaptionWrapsLongText(t *testing.T) {
+	text := "this caption is far too long to fit on one line of such a small image"
+	out, err := drawCaption(flatColor(240, 180, color.RGBA{40, 90, 160, 255}), text, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The text stays in the top third, and nothing of it is cut off at the
+	// sides.
+	rgba := out.(*image.RGBA)
+	background := color.RGBA{40, 90, 160, 255}
+	for y := 0; y < 180; y++ {
+		for _, x := range []int{0, 239} {
+			if rgba.RGBAAt(x, y) != background {
+				t.Fatalf("caption reaches the edge at (%d, %d)", x, y)
+			}
+		}
+		if y > 60 {
+			for x := 0; x < 240; x++ {
+				if rgba.RGBAAt(x, y) != background {
+					t.Fatalf("caption spills out of the top third at (%d, %d)", x, y)
+				}
+			}
+		}
+	}
+
+	if _, _, err := parseCaption(""); err == nil {
+		t.Error("an empty caption was accepted")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// grayTolerance is how far apart a pixel's channels can be for it to still
+// count as gray, since JPEGs of gray images often carry a little chroma noise.
+const grayTolerance = 2 << 8
+
+// efficientOutput reports whether encodes should pick the colour model that
+// fits the image rather than always writing full colour.
+func efficientOutput() bool {
+	return config.Image.EfficientOutput != "off"
+}
+
+// isGrayscale reports whether every pixel of img is (near enough) gray.
+func isGrayscale(img image.Image) bool {
+	switch img.ColorModel() {
+	case color.GrayModel, color.Gray16Model:
+		return true
+	}
+
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			if spread(r, g, bl) > grayTolerance {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func spread(r, g, b uint32) uint32 {
+	return max(r, g, b) - min(r, g, b)
+}
+
+// efficientImage converts gray images to image.Gray, which the JPEG encoder
+// writes with a single channel instead of three. Anything else is returned
+// as it is.
+func efficientImage(img image.Image) image.Image {
+	if !efficientOutput() {
+		return img
+	}
+	if _, ok := img.(*image.Gray); ok || !isGrayscale(img) {
+		return img
+	}
+	b := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(gray, gray.Bounds(), img, b.Min, draw.Src)
+	return gray
+}
+
+// sourcePalette returns the palette of a paletted image, like a GIF still,
+// so PNG output can stay paletted. It's nil for anything else.
+func sourcePalette(img image.Image) color.Palette {
+	if !efficientOutput() {
+		return nil
+	}
+	if p, ok := img.(*image.Paletted); ok {
+		return p.Palette
+	}
+	return nil
+}
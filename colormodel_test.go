@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// grayImage is a gray gradient stored as RGBA, like a decoded gray PNG.
+func grayImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8((x + y) * 255 / (w + h))
+			img.SetRGBA(x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	return img
+}
+
+func TestGrayscaleOutput(t *testing.T) {
+	model := func(img image.Image) color.Model {
+		t.Helper()
+		res, err := compress(img, options{Quality: 50}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := jpeg.Decode(bytes.NewReader(res.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return decoded.ColorModel()
+	}
+
+	withConfig(t, func(c *Config) { c.Image.EfficientOutput = "auto" })
+	if model(grayImage(32, 32)) != color.GrayModel {
+		t.Error("a gray source didn't give a single-channel JPEG")
+	}
+	if model(testImage(32, 32)) == color.GrayModel {
+		t.Error("a colour source came out gray")
+	}
+
+	withConfig(t, func(c *Config) { c.Image.EfficientOutput = "off" })
+	if model(grayImage(32, 32)) == color.GrayModel {
+		t.Error("with efficient_output off a gray source still gave a single-channel JPEG")
+	}
+}
+
+func TestPalettedPNGOutput(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Image.EfficientOutput = "auto" })
+	src := image.NewPaletted(image.Rect(0, 0, 32, 32), palette.Plan9)
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i % 64)
+	}
+
+	res, err := compress(src, options{Quality: 50, Format: "png"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(res.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := decoded.(*image.Paletted); !ok {
+		t.Errorf("PNG output of a paletted source is %T, want paletted", decoded)
+	}
+}
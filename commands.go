@@ -0,0 +1,379 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"image"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// options holds everything a mention asked for, parsed from its text.
+type options struct {
+	Quality           int     // JPEG quality, 0 for the default
+	SizeTarget        int64   // absolute byte budget, 0 when unset
+	SizePercent       float64 // byte budget as a percentage of the original, 0 when unset
+	Effects           []effectCall
+	Compare           bool // return the original and crunched image side by side
+	Crop              *image.Rectangle
+	Frame             int   // 1-based frame of an animated GIF to crunch as a still, 0 for all
+	Palette           bool  // list the original's dominant colours in the reply
+	Poll              bool  // follow the reply up with a poll on the crunch level
+	Seed              int64 // seeds effects that involve randomness
+	Format            string
+	Avatar            bool // crunch an account's avatar instead of the post's images
+	Generations       int  // re-crunch this many times and show every generation, 0 for off
+	GenerationCounter bool // label each generation's frame with its number
+	Explicit          bool // the mention contained at least one command
+	Sizes             bool // return the crunch at several smaller sizes
+	RestartRows       int  // rows of MCUs per JPEG restart interval, 0 for none
+	BitFlips          int  // bits to corrupt in the restart-marked output
+	Datamosh          bool // smear an animation's motion across its frames
+	DataURI           bool // reply with the crunch as a data: URI instead of an upload
+
+	// CaptionTop and CaptionBottom are burned onto the image meme-style.
+	CaptionTop    string
+	CaptionBottom string
+
+	// Save holds preferences to remember for the user ("set quality 30"),
+	// and Reset asks to forget them.
+	Save  *preferences
+	Reset bool
+}
+
+// quality resolves the JPEG quality to use, falling back to the configured
+// default.
+func (o options) quality() int {
+	quality := defaultQuality
+	switch {
+	case o.Quality != 0:
+		quality = o.Quality
+	case config.Image.Quality != 0:
+		quality = config.Image.Quality
+	}
+	return max(quality, safeModeQualityFloor())
+}
+
+var outputFormats = map[string]string{
+	"jpeg": "jpeg",
+	"jpg":  "jpeg",
+	"png":  "png",
+}
+
+func parseQuality(arg string) (int, error) {
+	quality, err := strconv.Atoi(arg)
+	if err != nil || quality < 1 || quality > 100 {
+		return 0, fmt.Errorf("%q isn't a quality from 1 to 100", arg)
+	}
+	return quality, nil
+}
+
+func parseFormat(arg string) (string, error) {
+	format, ok := outputFormats[strings.ToLower(arg)]
+	if !ok {
+		return "", fmt.Errorf("%q isn't a format I can output, try jpeg or png", arg)
+	}
+	return format, nil
+}
+
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// stripHTML turns a status' HTML content into plain text.
+func stripHTML(content string) string {
+	content = strings.ReplaceAll(content, "<br>", " ")
+	content = strings.ReplaceAll(content, "</p>", " ")
+	return html.UnescapeString(htmlTagPattern.ReplaceAllString(content, ""))
+}
+
+// tokenize splits a status' content into lowercase command words, dropping
+// mentions and any punctuation around the words ("Quality 20!" and
+// "quality 20" mean the same thing).
+func tokenize(content string) []string {
+	var tokens []string
+	for _, field := range strings.Fields(stripHTML(content)) {
+		field = strings.ToLower(trimPunctuation(field))
+		if field == "" || strings.HasPrefix(field, "@") {
+			continue
+		}
+		tokens = append(tokens, field)
+	}
+	return tokens
+}
+
+// trimPunctuation strips punctuation from either end of a word, leaving what
+// arguments need: a leading sign or decimal point and a trailing percent sign.
+func trimPunctuation(word string) string {
+	word = strings.TrimLeftFunc(word, func(r rune) bool {
+		return r != '@' && r != '-' && r != '+' && r != '.' && isPunctuation(r)
+	})
+	return strings.TrimRightFunc(word, func(r rune) bool {
+		return r != '%' && isPunctuation(r)
+	})
+}
+
+func isPunctuation(r rune) bool {
+	return unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
+
+// parseMentionOptions parses the commands in a mention. When the content has
+// none, the content warning is tried instead, since some people put them
+// there when that's all there is besides the mention. A CW is usually just a
+// description though ("low quality pic"), so if it doesn't parse it's
+// treated as having no commands rather than as a mistake.
+func parseMentionOptions(content, spoiler string) (options, error) {
+	opts, err := parseOptions(content)
+	if err != nil || opts.Explicit || strings.TrimSpace(spoiler) == "" {
+		return opts, err
+	}
+	fromCW, err := parseOptions(spoiler)
+	if err != nil {
+		return opts, nil
+	}
+	return fromCW, nil
+}
+
+func parseOptions(content string) (options, error) {
+	var opts options
+	tokens := tokenize(content)
+
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "size":
+			if i+1 >= len(tokens) {
+				return opts, fmt.Errorf("size needs a target, like \"size 50kb\" or \"size 10%%\"")
+			}
+			i++
+			if err := parseSize(tokens[i], &opts); err != nil {
+				return opts, err
+			}
+		case "quality":
+			if i+1 >= len(tokens) {
+				return opts, fmt.Errorf("quality needs a number from 1 to 100")
+			}
+			i++
+			quality, err := parseQuality(tokens[i])
+			if err != nil {
+				return opts, err
+			}
+			opts.Quality = quality
+		case "format":
+			if i+1 >= len(tokens) {
+				return opts, fmt.Errorf("format needs a format, like \"format png\"")
+			}
+			i++
+			format, err := parseFormat(tokens[i])
+			if err != nil {
+				return opts, err
+			}
+			opts.Format = format
+		case "set":
+			if i+2 >= len(tokens) {
+				return opts, fmt.Errorf("set needs a setting and a value, like \"set quality 30\"")
+			}
+			if opts.Save == nil {
+				opts.Save = &preferences{}
+			}
+			key, value := tokens[i+1], tokens[i+2]
+			i += 2
+			var err error
+			switch key {
+			case "quality":
+				opts.Save.Quality, err = parseQuality(value)
+			case "format":
+				opts.Save.Format, err = parseFormat(value)
+			default:
+				err = fmt.Errorf("I can only remember quality and format, not %q", key)
+			}
+			if err != nil {
+				return opts, err
+			}
+		case "reset":
+			opts.Reset = true
+		case "compare":
+			opts.Compare = true
+		case "palette":
+			opts.Palette = true
+		case "restart":
+			if config.SafeMode.Enabled {
+				return opts, fmt.Errorf("restart glitches are turned off here")
+			}
+			opts.RestartRows = 1
+			if i+1 < len(tokens) && looksLikeArg(tokens[i+1]) {
+				i++
+				rows, err := strconv.Atoi(tokens[i])
+				if err != nil || rows < 1 || rows > maxRestartRows {
+					return opts, fmt.Errorf("%q isn't a restart interval from 1 to %d rows", tokens[i], maxRestartRows)
+				}
+				opts.RestartRows = rows
+			}
+			if i+1 < len(tokens) && looksLikeArg(tokens[i+1]) {
+				i++
+				flips, err := strconv.Atoi(tokens[i])
+				if err != nil || flips < 0 || flips > maxBitFlips {
+					return opts, fmt.Errorf("%q isn't a number of bit flips from 0 to %d", tokens[i], maxBitFlips)
+				}
+				opts.BitFlips = flips
+			}
+		case "caption":
+			top, bottom, err := parseCaption(captionText(content))
+			if err != nil {
+				return opts, err
+			}
+			opts.CaptionTop, opts.CaptionBottom = top, bottom
+			// The caption is the rest of the post.
+			i = len(tokens)
+		case "sizes":
+			opts.Sizes = true
+		case "datamosh":
+			opts.Datamosh = true
+		case "datauri":
+			opts.DataURI = true
+		case "poll":
+			opts.Poll = true
+		case "avatar":
+			opts.Avatar = true
+		case "crop":
+			if i+1 >= len(tokens) {
+				return opts, fmt.Errorf("crop needs a region like \"crop 10,10,200,200\"")
+			}
+			i++
+			region, err := parseRegion(tokens[i])
+			if err != nil {
+				return opts, err
+			}
+			opts.Crop = &region
+		case "generations":
+			opts.Generations = defaultGenerations
+			if i+1 < len(tokens) && looksLikeArg(tokens[i+1]) {
+				i++
+				n, err := strconv.Atoi(tokens[i])
+				if err != nil || n < 1 || n > maxGenerations {
+					return opts, fmt.Errorf("%q isn't a number of generations from 1 to %d", tokens[i], maxGenerations)
+				}
+				opts.Generations = n
+			}
+		case "counter":
+			opts.GenerationCounter = true
+		case "frame":
+			if i+1 >= len(tokens) {
+				return opts, fmt.Errorf("frame needs a frame number, like \"frame 3\"")
+			}
+			i++
+			frame, err := strconv.Atoi(tokens[i])
+			if err != nil || frame < 1 {
+				return opts, fmt.Errorf("%q isn't a frame number", tokens[i])
+			}
+			opts.Frame = frame
+		default:
+			e, ok := effects[tokens[i]]
+			if !ok {
+				continue
+			}
+			if !effectAllowed(tokens[i]) {
+				return opts, fmt.Errorf("the %s effect is turned off here", tokens[i])
+			}
+			call := effectCall{Name: tokens[i]}
+			for len(call.Args) < e.maxArgs && i+1 < len(tokens) && looksLikeArg(tokens[i+1]) {
+				i++
+				call.Args = append(call.Args, tokens[i])
+			}
+			opts.Effects = append(opts.Effects, call)
+		}
+		// Only reached for words that are commands.
+		opts.Explicit = true
+	}
+
+	// A counter only makes sense on a progression.
+	if opts.GenerationCounter && opts.Generations == 0 {
+		opts.Generations = defaultGenerations
+	}
+
+	// Some effects bring their own quality unless one was asked for
+	// explicitly.
+	for _, call := range opts.Effects {
+		qualityFor := effects[call.Name].quality
+		if qualityFor == nil {
+			continue
+		}
+		quality, err := qualityFor(call.Args)
+		if err != nil {
+			return opts, err
+		}
+		if opts.Quality == 0 {
+			opts.Quality = quality
+		}
+	}
+
+	return opts, nil
+}
+
+// looksLikeArg reports whether a token is a numeric argument rather than the
+// next command word.
+func looksLikeArg(token string) bool {
+	if token == "" {
+		return false
+	}
+	switch c := token[0]; {
+	case c >= '0' && c <= '9', c == '-', c == '+', c == '.':
+		return true
+	}
+	return false
+}
+
+// parseSize accepts either an absolute size ("50000", "50kb", "1.5mb") or a
+// percentage of the original file ("10%").
+func parseSize(arg string, opts *options) error {
+	arg = strings.ToLower(arg)
+
+	if strings.HasSuffix(arg, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(arg, "%"), 64)
+		if err != nil || math.IsNaN(percent) || percent <= 0 || percent > 100 {
+			return fmt.Errorf("%q isn't a percentage between 0 and 100", arg)
+		}
+		opts.SizePercent = percent
+		return nil
+	}
+
+	multiplier := 1.0
+	number := arg
+	switch {
+	case strings.HasSuffix(arg, "kb"):
+		multiplier, number = 1024, strings.TrimSuffix(arg, "kb")
+	case strings.HasSuffix(arg, "mb"):
+		multiplier, number = 1024*1024, strings.TrimSuffix(arg, "mb")
+	case strings.HasSuffix(arg, "b"):
+		number = strings.TrimSuffix(arg, "b")
+	}
+
+	// ParseFloat takes "nan" and "inf" too, and anything under a byte would
+	// round down to no target at all.
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) || value*multiplier < 1 {
+		return fmt.Errorf("%q isn't a size I understand", arg)
+	}
+	opts.SizeTarget = int64(value * multiplier)
+	return nil
+}
+
+// budget returns the byte budget requested for an original of the given
+// length, or 0 if no size target was set.
+func (o options) budget(originalLength int) int64 {
+	if o.SizePercent > 0 {
+		return int64(float64(originalLength) * o.SizePercent / 100)
+	}
+	return o.SizeTarget
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+	case n >= 1024:
+		return fmt.Sprintf("%.1f KB", float64(n)/1024)
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMessyCommands(t *testing.T) {
+	tests := []struct {
+		content string
+		want    options
+	}{
+		{
+			content: `<p><span class="h-card"><a href="https://example.com/@bot" class="u-url mention">@<span>bot</span></a></span> QUALITY   20!</p>`,
+			want:    options{Quality: 20, Explicit: true},
+		},
+		{
+			content: "<p>@bot\tFormat: PNG,<br>Compare.</p>",
+			want:    options{Format: "png", Compare: true, Explicit: true},
+		},
+		{
+			content: "<p>@bot   size 50KB please &amp; thanks</p>",
+			want:    options{SizeTarget: 50 * 1024, Explicit: true},
+		},
+		{
+			content: "<p>@bot (size 10%)</p>",
+			want:    options{SizePercent: 10, Explicit: true},
+		},
+		{
+			content: "<p>@bot crunch this pls</p>",
+			want:    options{},
+		},
+	}
+	for _, tt := range tests {
+		got, err := parseOptions(tt.content)
+		if err != nil {
+			t.Errorf("%q: %v", tt.content, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q parsed as %+v, want %+v", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestParseSizeRejectsNonsense(t *testing.T) {
+	for _, bad := range []string{"nan", "nanb", "inf", "-inf", "infinitykb", "0.5b", "0.0001kb", "0", "nan%", "inf%"} {
+		var opts options
+		if err := parseSize(bad, &opts); err == nil {
+			t.Errorf("%q parsed as a target of %d bytes (%v%%)", bad, opts.SizeTarget, opts.SizePercent)
+		}
+	}
+
+	var opts options
+	if err := parseSize("1b", &opts); err != nil || opts.SizeTarget != 1 {
+		t.Errorf("1b parsed as %d, %v; want a 1 byte target", opts.SizeTarget, err)
+	}
+}
+
+func TestParseEffectArgs(t *testing.T) {
+	got, err := parseOptions("<p>@bot WAVE 12, 4 then CRT!</p>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []effectCall{{Name: "wave", Args: []string{"12", "4"}}, {Name: "crt"}}
+	if !reflect.DeepEqual(got.Effects, want) {
+		t.Errorf("effects are %+v, want %+v", got.Effects, want)
+	}
+}
+
+func TestSafeMode(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.SafeMode.Enabled = true
+		c.SafeMode.Effects = nil
+		c.SafeMode.QualityFloor = 0
+	})
+
+	for _, tame := range []string{"@bot crt", "@bot aberrate 3", "@bot era 2000"} {
+		if _, err := parseOptions(tame); err != nil {
+			t.Errorf("%q was refused in safe mode: %v", tame, err)
+		}
+	}
+	for _, wild := range []string{"@bot tile", "@bot noise 1", "@bot restart 2"} {
+		if _, err := parseOptions(wild); err == nil {
+			t.Errorf("%q was allowed in safe mode", wild)
+		}
+	}
+
+	opts, _ := parseOptions("@bot quality 1")
+	if got := opts.quality(); got != defaultSafeQualityFloor {
+		t.Errorf("quality 1 in safe mode gave %d, want the floor of %d", got, defaultSafeQualityFloor)
+	}
+
+	withConfig(t, func(c *Config) { c.SafeMode.Effects = []string{"noise"} })
+	if _, err := parseOptions("@bot noise"); err != nil {
+		t.Errorf("configured safe effect was refused: %v", err)
+	}
+	if _, err := parseOptions("@bot crt"); err == nil {
+		t.Error("effect left out of the configured list was allowed")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// conversationTracker remembers when the bot last replied in each
+// conversation, identified by the ID of the thread's first post.
+type conversationTracker struct {
+	mu      sync.Mutex
+	replied map[mastodon.ID]time.Time
+}
+
+var conversations = &conversationTracker{replied: make(map[mastodon.ID]time.Time)}
+
+// recentlyReplied reports whether the bot replied in the conversation within
+// the last window. A zero window turns tracking off.
+func (t *conversationTracker) recentlyReplied(id mastodon.ID, window time.Duration) bool {
+	if window <= 0 || id == "" {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	last, ok := t.replied[id]
+	return ok && time.Since(last) < window
+}
+
+func (t *conversationTracker) record(id mastodon.ID) {
+	if config.Bot.ThreadCooldown <= 0 || id == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.replied[id] = time.Now()
+
+	// Forget conversations whose cooldown is long over.
+	for other, last := range t.replied {
+		if time.Since(last) > config.Bot.ThreadCooldown {
+			delete(t.replied, other)
+		}
+	}
+}
+
+// conversationRoot finds the first post of the thread status belongs to. It
+// only asks the instance when tracking is on and status is a reply.
+func conversationRoot(client *mastodon.Client, status *mastodon.Status) mastodon.ID {
+	if config.Bot.ThreadCooldown <= 0 || status.InReplyToID == nil {
+		return status.ID
+	}
+
+	thread, err := client.GetStatusContext(ctx, status.ID)
+	if err != nil {
+		log.Printf("Error fetching context of %s: %v", status.ID, err)
+		return status.ID
+	}
+	if len(thread.Ancestors) > 0 {
+		return thread.Ancestors[0].ID
+	}
+	return status.ID
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+func TestThreadCooldown(t *testing.T) {
+	f, client := newFakeInstance(t)
+	saved := conversations
+	t.Cleanup(func() { conversations = saved })
+	conversations = &conversationTracker{replied: make(map[mastodon.ID]time.Time)}
+	withConfig(t, func(c *Config) { c.Bot.ThreadCooldown = time.Hour })
+
+	root := &mastodon.Status{
+		ID:               "root",
+		MediaAttachments: []mastodon.Attachment{{Type: "image", URL: f.serveFile("/media/root.png", "image/png", encodePNG(t, testImage(16, 16)))}},
+	}
+	f.addStatus(root)
+
+	reply := func(id, content string) *mastodon.Notification {
+		f.handle(http.MethodGet, fmt.Sprintf("/api/v1/statuses/%s/context", id), func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, mastodon.Context{Ancestors: []*mastodon.Status{root}})
+		})
+		n := mention(id, "alice", content)
+		n.Status.InReplyToID = "root"
+		return n
+	}
+
+	handleMention(client, reply("1", "<p>@bot</p>"))
+	if n := len(f.posted()); n != 1 {
+		t.Fatalf("first mention got %d replies, want 1", n)
+	}
+
+	handleMention(client, reply("2", "<p>@bot lol</p>"))
+	if n := len(f.posted()); n != 1 {
+		t.Errorf("casual mention in the same thread got a reply")
+	}
+
+	handleMention(client, reply("3", "<p>@bot quality 20</p>"))
+	if n := len(f.posted()); n != 2 {
+		t.Errorf("explicit command in the same thread was suppressed")
+	}
+}
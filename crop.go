@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"strconv"
+	"strings"
+)
+
+// parseRegion parses "x0,y0,x1,y1", the top-left and bottom-right corners of
+// a rectangle in pixels.
+func parseRegion(arg string) (image.Rectangle, error) {
+	parts := strings.Split(arg, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("crop needs four numbers like \"crop 10,10,200,200\"")
+	}
+
+	var coords [4]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 0 {
+			return image.Rectangle{}, fmt.Errorf("%q isn't a valid crop coordinate", part)
+		}
+		coords[i] = n
+	}
+
+	if coords[2] <= coords[0] || coords[3] <= coords[1] {
+		return image.Rectangle{}, fmt.Errorf("the crop's second corner has to be below and to the right of the first")
+	}
+	return image.Rect(coords[0], coords[1], coords[2], coords[3]), nil
+}
+
+// cropImage returns the part of img inside region, which is relative to the
+// image's top-left corner.
+func cropImage(img image.Image, region image.Rectangle) (image.Image, error) {
+	b := img.Bounds()
+	region = region.Add(b.Min)
+	if !region.In(b) {
+		return nil, fmt.Errorf("the crop %d,%d,%d,%d doesn't fit inside the %dx%d image",
+			region.Min.X-b.Min.X, region.Min.Y-b.Min.Y, region.Max.X-b.Min.X, region.Max.Y-b.Min.Y, b.Dx(), b.Dy())
+	}
+
+	if sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(region), nil
+	}
+
+	cropped := image.NewRGBA(image.Rect(0, 0, region.Dx(), region.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), img, region.Min, draw.Src)
+	return cropped, nil
+}
+
+// pasteCrunched puts the crunched region back into the untouched original.
+// The result is encoded losslessly so everything outside the region stays as
+// it was.
+func pasteCrunched(original image.Image, region image.Rectangle, crunched result) (result, error) {
+	crunchedImg, _, err := decodeImage(crunched.Data)
+	if err != nil {
+		return result{}, fmt.Errorf("error decoding crunched region: %w", err)
+	}
+
+	b := original.Bounds()
+	canvas := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(canvas, canvas.Bounds(), original, b.Min, draw.Src)
+	draw.Draw(canvas, region, crunchedImg, crunchedImg.Bounds().Min, draw.Src)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas); err != nil {
+		return result{}, fmt.Errorf("error encoding cropped image: %w", err)
+	}
+	return result{Data: buf.Bytes(), Format: "png", Note: crunched.Note}, nil
+}
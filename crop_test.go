@@ -0,0 +1,69 @@
+package main
+
+import (
+	"image"
+	"strings"
+	"testing"
+)
+
+func TestParseRegion(t *testing.T) {
+	got, err := parseRegion("10,20,110,220")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := image.Rect(10, 20, 110, 220); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, bad := range []string{"10,20,110", "a,b,c,d", "-5,0,10,10", "50,50,10,10", "10,10,10,20"} {
+		if _, err := parseRegion(bad); err == nil {
+			t.Errorf("%q parsed without an error", bad)
+		}
+	}
+}
+
+func TestCropImage(t *testing.T) {
+	img := testImage(64, 48)
+
+	cropped, err := cropImage(img, image.Rect(8, 8, 40, 24))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cropped.Bounds().Size(); got != image.Pt(32, 16) {
+		t.Errorf("cropped to %v, want 32×16", got)
+	}
+	if cropped.At(cropped.Bounds().Min.X, cropped.Bounds().Min.Y) != img.At(8, 8) {
+		t.Error("crop doesn't start at the region's corner")
+	}
+
+	_, err = cropImage(img, image.Rect(40, 40, 80, 60))
+	if err == nil || !strings.Contains(err.Error(), "doesn't fit inside the 64x48 image") {
+		t.Errorf("out of bounds crop gave %v", err)
+	}
+}
+
+func TestCropInPlace(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Image.CropMode = "inplace" })
+	img := testImage(64, 48)
+
+	out := crunch(t, img, "@bot crop 0,0,32,48 quality 1")
+	if got := out.Bounds().Size(); got != image.Pt(64, 48) {
+		t.Fatalf("in-place crop is %v, want the whole 64×48 image", got)
+	}
+	// Only the cropped half was crunched; the rest is untouched.
+	for y := 0; y < 48; y++ {
+		for x := 32; x < 64; x++ {
+			if !sameColor(out.At(x, y), img.At(x, y)) {
+				t.Fatalf("pixel %d,%d outside the crop changed", x, y)
+			}
+		}
+	}
+	left := image.Rect(0, 0, 32, 48)
+	if meanDifference(out.(subImager).SubImage(left), img.SubImage(left)) == 0 {
+		t.Error("the cropped region wasn't crunched")
+	}
+}
+
+type subImager interface {
+	SubImage(r image.Rectangle) image.Image
+}
@@ -0,0 +1,79 @@
+package main
+
+import "image"
+
+const (
+	// Motion is estimated per block, searching this many pixels either way
+	// and comparing a sparse grid of sample pixels, which keeps the cost at a
+	// fixed amount of work per pixel of each frame.
+	moshBlock  = 16
+	moshSearch = 4
+	moshSample = 4
+)
+
+// datamosh fakes the look of a video with its keyframes removed: only the
+// first frame is shown as it is, and every later one is built by moving
+// blocks of the previous output along with the motion between the
+// corresponding source frames. Nothing new ever gets drawn, so movement
+// drags the first frame's pixels around instead of revealing what's really
+// there.
+func datamosh(frames []*image.RGBA) []*image.RGBA {
+	if len(frames) < 2 {
+		return frames
+	}
+
+	b := frames[0].Bounds()
+	state := cloneRGBA(frames[0])
+	moshed := []*image.RGBA{state}
+	for i := 1; i < len(frames); i++ {
+		prev, cur := frames[i-1], frames[i]
+		next := image.NewRGBA(b)
+		for by := b.Min.Y; by < b.Max.Y; by += moshBlock {
+			for bx := b.Min.X; bx < b.Max.X; bx += moshBlock {
+				block := image.Rect(bx, by, bx+moshBlock, by+moshBlock).Intersect(b)
+				dx, dy := estimateMotion(prev, cur, block)
+				for y := block.Min.Y; y < block.Max.Y; y++ {
+					for x := block.Min.X; x < block.Max.X; x++ {
+						sx := clampInt(x+dx, b.Min.X, b.Max.X-1)
+						sy := clampInt(y+dy, b.Min.Y, b.Max.Y-1)
+						next.SetRGBA(x, y, state.RGBAAt(sx, sy))
+					}
+				}
+			}
+		}
+		state = next
+		moshed = append(moshed, state)
+	}
+	return moshed
+}
+
+// estimateMotion finds where block of cur most likely came from in prev,
+// as an offset into prev.
+func estimateMotion(prev, cur *image.RGBA, block image.Rectangle) (dx, dy int) {
+	b := prev.Bounds()
+	best := -1
+	for oy := -moshSearch; oy <= moshSearch; oy++ {
+		for ox := -moshSearch; ox <= moshSearch; ox++ {
+			diff := 0
+			for y := block.Min.Y; y < block.Max.Y; y += moshSample {
+				for x := block.Min.X; x < block.Max.X; x += moshSample {
+					p := cur.RGBAAt(x, y)
+					q := prev.RGBAAt(clampInt(x+ox, b.Min.X, b.Max.X-1), clampInt(y+oy, b.Min.Y, b.Max.Y-1))
+					diff += absInt(int(p.R)-int(q.R)) + absInt(int(p.G)-int(q.G)) + absInt(int(p.B)-int(q.B))
+				}
+			}
+			// Ties go to the smallest offset so still areas stay still.
+			if best < 0 || diff < best || (diff == best && absInt(ox)+absInt(oy) < absInt(dx)+absInt(dy)) {
+				best, dx, dy = diff, ox, oy
+			}
+		}
+	}
+	return dx, dy
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
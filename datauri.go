@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// dataURI renders an encoded image as a data: URI.
+func dataURI(res result) string {
+	return "data:" + formatMimeTypes[res.Format] + ";base64," + base64.StdEncoding.EncodeToString(res.Data)
+}
+
+// replyWithDataURIs answers a "datauri" mention with each crunched image
+// written out as a data: URI instead of uploaded. Only tiny images fit in a
+// post, so anything bigger gets an apology saying how far over it is. It
+// returns the last reply posted, or nil if none were.
+func replyWithDataURIs(client *mastodon.Client, b batch, notification *mastodon.Notification, visibility string) *mastodon.Status {
+	if len(b.failures) > 0 {
+		replyWithError(client, notification, strings.Join(b.failures, " "))
+	}
+	visibility = replyVisibility(visibility)
+
+	var posted *mastodon.Status
+	for _, res := range b.results {
+		uri := dataURI(res)
+		text := newReplyText(notification, uri)
+		if !text.fits() {
+			replyWithError(client, notification, fmt.Sprintf(
+				"That's %d characters as a data URI, which doesn't fit in a post. Only really tiny images do, try one a few pixels across with \"format png\".",
+				length(uri)))
+			continue
+		}
+
+		reply := &mastodon.Toot{
+			Status:      text.String(),
+			InReplyToID: notification.Status.ID,
+			Visibility:  visibility,
+			Language:    replyLanguage(notification),
+			Sensitive:   b.sensitive,
+			SpoilerText: b.spoiler,
+		}
+		status, err := postStatus(client, reply)
+		if err != nil {
+			replyWithError(client, notification, fmt.Sprintf("Error posting reply: %v", err))
+			continue
+		}
+		mirrorReply(client, notification, status)
+		posted = status
+	}
+	return posted
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image/png"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/mattn/go-mastodon"
+)
+
+var dataURIPattern = regexp.MustCompile(`data:image/png;base64,([A-Za-z0-9+/=]+)`)
+
+func TestDataURIReply(t *testing.T) {
+	f, client := newFakeInstance(t)
+	withConfig(t, func(c *Config) { c.Reply.MaxLength = 5000 })
+
+	notification := mention("1", "alice", "<p>@bot datauri format png</p>")
+	notification.Status.MediaAttachments = []mastodon.Attachment{
+		{Type: "image", URL: f.serveFile("/media/tiny.png", "image/png", encodePNG(t, testImage(4, 3)))},
+	}
+	handleMention(client, notification)
+
+	posts := f.posted()
+	if len(posts) != 1 {
+		t.Fatalf("posted %d replies, want 1", len(posts))
+	}
+	match := dataURIPattern.FindStringSubmatch(posts[0].Get("status"))
+	if match == nil {
+		t.Fatalf("reply %q has no PNG data URI", posts[0].Get("status"))
+	}
+	data, err := base64.StdEncoding.DecodeString(match[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("data URI isn't a PNG: %v", err)
+	}
+	if img.Bounds().Dx() != 4 || img.Bounds().Dy() != 3 {
+		t.Errorf("data URI image is %v, want 4x3", img.Bounds())
+	}
+	if got := posts[0].Get("visibility"); got != "unlisted" {
+		t.Errorf("data URI reply to a public mention is %q, want unlisted", got)
+	}
+	if len(f.uploaded()) != 0 {
+		t.Error("data URI reply uploaded media")
+	}
+}
+
+func TestDataURITooLong(t *testing.T) {
+	f, client := newFakeInstance(t)
+	withConfig(t, func(c *Config) { c.Reply.MaxLength = 500 })
+
+	res := result{Data: encodePNG(t, testImage(64, 64)), Format: "png"}
+	uri := dataURI(res)
+	if !strings.HasPrefix(uri, "data:image/png;base64,") || len(uri) <= 500 {
+		t.Fatalf("test image's data URI is %d characters, want over 500", len(uri))
+	}
+
+	replyWithDataURIs(client, batch{results: []result{res}}, mention("1", "alice", "<p>@bot datauri</p>"), "public")
+	posts := f.posted()
+	if len(posts) != 1 || !strings.Contains(posts[0].Get("status"), "doesn't fit in a post") {
+		t.Fatalf("replied %v, want an apology", posts)
+	}
+	if !strings.Contains(posts[0].Get("status"), fmt.Sprintf("That's %d characters", len(uri))) {
+		t.Errorf("apology %q doesn't say how long the URI is", posts[0].Get("status"))
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// editDebouncer holds mentions back for a short window so that a mention
+// edited a few times in quick succession is only handled once, using the
+// latest version of the status.
+type editDebouncer struct {
+	mu      sync.Mutex
+	pending map[mastodon.ID]*pendingMention
+}
+
+type pendingMention struct {
+	notification *mastodon.Notification
+	timer        *time.Timer
+}
+
+var edits = &editDebouncer{pending: make(map[mastodon.ID]*pendingMention)}
+
+// debounce arranges for run to be called with notification once window has
+// passed without another event for the same status. An event that arrives
+// in the meantime takes its place and restarts the wait.
+func (d *editDebouncer) debounce(notification *mastodon.Notification, window time.Duration, run func(*mastodon.Notification)) {
+	id := notification.Status.ID
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if p, ok := d.pending[id]; ok {
+		p.notification = notification
+		p.timer.Reset(window)
+		return
+	}
+
+	p := &pendingMention{notification: notification}
+	p.timer = time.AfterFunc(window, func() {
+		d.mu.Lock()
+		latest := p.notification
+		delete(d.pending, id)
+		d.mu.Unlock()
+		run(latest)
+	})
+	d.pending[id] = p
+}
+
+// update swaps an edited status into the mention waiting on it, restarting
+// the wait. It reports whether there was one; edits of mentions that were
+// already handled are ignored.
+func (d *editDebouncer) update(status *mastodon.Status, window time.Duration) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.pending[status.ID]
+	if !ok {
+		return false
+	}
+	edited := *p.notification
+	edited.Status = status
+	p.notification = &edited
+	p.timer.Reset(window)
+	return true
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"log"
+
+	"golang.org/x/image/webp"
+)
+
+// stillDecoder is one way of decoding a still image, returning the format it
+// decoded.
+type stillDecoder func(imgData []byte) (image.Image, string, error)
+
+// stillDecoders are the decoders decoder_order can chain together:
+// "sniffed" picks a decoder from the leading magic bytes, "webp" tries
+// x/image/webp directly, and "scan" looks for an image that doesn't start
+// at the very beginning of the file.
+var stillDecoders = map[string]stillDecoder{
+	"sniffed": decodeSniffed,
+	"webp":    decodeWebP,
+	"scan":    decodeScan,
+}
+
+var defaultDecoderOrder = []string{"sniffed", "webp"}
+
+// decodeWithFallbacks runs the configured decoders in order until one of
+// them succeeds, returning the first decoder's error if none do.
+func decodeWithFallbacks(imgData []byte) (image.Image, string, error) {
+	order := config.Image.DecoderOrder
+	if len(order) == 0 {
+		order = defaultDecoderOrder
+	}
+
+	var firstErr error
+	for i, name := range order {
+		decode, ok := stillDecoders[name]
+		if !ok {
+			log.Printf("Unknown decoder %q in decoder_order, skipping it", name)
+			continue
+		}
+		img, format, err := decode(imgData)
+		if err == nil {
+			if i > 0 {
+				log.Printf("Decoded %s with the %s decoder after %v", format, name, firstErr)
+			}
+			return img, format, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = fmt.Errorf("no decoders configured")
+	}
+	return nil, "", firstErr
+}
+
+func decodeSniffed(imgData []byte) (image.Image, string, error) {
+	return image.Decode(bytes.NewReader(imgData))
+}
+
+func decodeWebP(imgData []byte) (image.Image, string, error) {
+	img, err := webp.Decode(bytes.NewReader(imgData))
+	return img, "webp", err
+}
+
+// maxScanOffset is how far into a file "scan" looks for an image signature.
+const maxScanOffset = 1024
+
+var imageSignatures = [][]byte{
+	{0xff, 0xd8, 0xff},
+	[]byte("\x89PNG\r\n\x1a\n"),
+	[]byte("GIF87a"),
+	[]byte("GIF89a"),
+}
+
+// decodeScan skips junk in front of the image, like a byte order mark or a
+// stray HTTP header some servers prepend, by decoding from the first image
+// signature within maxScanOffset bytes.
+func decodeScan(imgData []byte) (image.Image, string, error) {
+	for offset := 1; offset < min(len(imgData), maxScanOffset); offset++ {
+		for _, signature := range imageSignatures {
+			if bytes.HasPrefix(imgData[offset:], signature) {
+				return image.Decode(bytes.NewReader(imgData[offset:]))
+			}
+		}
+	}
+	return nil, "", fmt.Errorf("no image signature in the first %d bytes", maxScanOffset)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/binary"
+	"image"
+	"testing"
+)
+
+// riffWebP wraps a chunk in the RIFF container of a WebP file.
+func riffWebP(fourCC string, payload []byte) []byte {
+	chunk := append([]byte(fourCC), make([]byte, 4)...)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(payload)))
+	chunk = append(chunk, payload...)
+
+	data := append([]byte("RIFF"), make([]byte, 4)...)
+	binary.LittleEndian.PutUint32(data[4:], uint32(4+len(chunk)))
+	data = append(data, "WEBP"...)
+	return append(data, chunk...)
+}
+
+func TestMalformedWebP(t *testing.T) {
+	inputs := map[string][]byte{
+		"truncated header": []byte("RIFF\x10\x00\x00\x00WEBPVP8"),
+		// A lossless header claiming a 16384×16384 image, then nothing.
+		"lossless no data": riffWebP("VP8L", []byte{0x2f, 0xff, 0xff, 0xff, 0xff}),
+		// A lossy keyframe header with garbage partitions.
+		"lossy garbage":     riffWebP("VP8 ", []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a, 0x08, 0x00, 0x08, 0x00, 0xff, 0xff, 0xff, 0xff}),
+		"extended no image": riffWebP("VP8X", make([]byte, 10)),
+	}
+	for name, data := range inputs {
+		t.Run(name, func(t *testing.T) {
+			if _, _, err := decodeImage(data); err == nil {
+				t.Error("malformed WebP decoded without an error")
+			}
+		})
+	}
+}
+
+func TestDecoderPanicBecomesError(t *testing.T) {
+	stillDecoders["panics"] = func([]byte) (image.Image, string, error) {
+		panic("index out of range")
+	}
+	t.Cleanup(func() { delete(stillDecoders, "panics") })
+	withConfig(t, func(c *Config) { c.Image.DecoderOrder = []string{"panics"} })
+
+	_, _, err := decodeImage(riffWebP("VP8L", []byte{0x2f}))
+	if err == nil || err.Error() != "the image is malformed" {
+		t.Errorf("panicking decoder gave %v, want a malformed image error", err)
+	}
+}
+
+func TestDecoderFallback(t *testing.T) {
+	// A PNG behind a stray header that image.Decode doesn't recognise.
+	data := append([]byte("\xef\xbb\xbfContent-Type: image/png\r\n\r\n"), encodePNG(t, testImage(10, 6))...)
+
+	withConfig(t, func(c *Config) { c.Image.DecoderOrder = []string{"sniffed", "webp"} })
+	if _, _, err := decodeImage(data); err == nil {
+		t.Fatal("an image behind junk decoded without the scan decoder")
+	}
+
+	withConfig(t, func(c *Config) { c.Image.DecoderOrder = []string{"sniffed", "nonexistent", "webp", "scan"} })
+	img, format, err := decodeImage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "png" || img.Bounds().Dx() != 10 || img.Bounds().Dy() != 6 {
+		t.Errorf("scan decoded a %s of %v, want a 10x6 png", format, img.Bounds())
+	}
+
+	// When every decoder fails, the error is the first one's.
+	withConfig(t, func(c *Config) { c.Image.DecoderOrder = []string{"sniffed", "scan"} })
+	_, _, err = decodeWithFallbacks([]byte("nothing to see here"))
+	if err == nil || err.Error() != "image: unknown format" {
+		t.Errorf("all decoders failing gave %v, want the sniffed decoder's error", err)
+	}
+}
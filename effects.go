@@ -0,0 +1,654 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// effect is an image transformation applied before crunching, requested by
+// name in a mention ("@jpegbot crt").
+type effect struct {
+	// maxArgs is how many arguments may follow the effect's name.
+	maxArgs int
+	// apply transforms img. Effects with any randomness draw it from rng so
+	// results are reproducible for a given seed.
+	apply func(img image.Image, args []string, rng *rand.Rand) (image.Image, error)
+	// quality, if set, picks the final crunch's quality when the mention
+	// didn't ask for one.
+	quality func(args []string) (int, error)
+	// inapplicable, if set, explains why the effect would do nothing
+	// useful to img, or returns "" if it's fine.
+	inapplicable func(img image.Image) string
+}
+
+// effectCall is one requested effect along with its arguments.
+type effectCall struct {
+	Name string
+	Args []string
+}
+
+var effects = map[string]effect{
+	"aberrate":     {maxArgs: 1, apply: aberrateEffect},
+	"bg":           {maxArgs: 1, apply: bgEffect, quality: fixedQuality(90)},
+	"crt":          {apply: crtEffect},
+	"edges":        {maxArgs: 1, apply: edgesEffect, inapplicable: flatImage},
+	"era":          {maxArgs: 1, apply: eraEffect, quality: eraQuality},
+	"film":         {maxArgs: 2, apply: filmEffect},
+	"gradient":     {apply: gradientEffect, quality: fixedQuality(90)},
+	"grayscale":    {apply: grayscaleEffect, inapplicable: alreadyGray},
+	"kaleidoscope": {maxArgs: 1, apply: kaleidoscopeEffect},
+	"loading":      {maxArgs: 1, apply: loadingEffect},
+	"mirror":       {apply: mirrorEffect},
+	"noise":        {maxArgs: 1, apply: noiseEffect},
+	"pattern":      {maxArgs: 1, apply: patternEffect},
+	"tile":         {maxArgs: 1, apply: tileEffect},
+	"wave":         {maxArgs: 2, apply: waveEffect},
+}
+
+var defaultSafeEffects = []string{"aberrate", "crt", "era"}
+
+const defaultSafeQualityFloor = 20
+
+// effectAllowed reports whether an effect may be used, which in safe mode
+// means it's one of the configured tame effects.
+func effectAllowed(name string) bool {
+	if !config.SafeMode.Enabled {
+		return true
+	}
+	allowed := config.SafeMode.Effects
+	if allowed == nil {
+		allowed = defaultSafeEffects
+	}
+	for _, a := range allowed {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// safeModeQualityFloor is the lowest quality allowed, 0 outside safe mode.
+func safeModeQualityFloor() int {
+	if !config.SafeMode.Enabled {
+		return 0
+	}
+	if config.SafeMode.QualityFloor > 0 {
+		return config.SafeMode.QualityFloor
+	}
+	return defaultSafeQualityFloor
+}
+
+func applyEffects(img image.Image, calls []effectCall, seed int64) (image.Image, error) {
+	for _, call := range calls {
+		var err error
+		img, err = effects[call.Name].apply(img, call.Args, rand.New(rand.NewSource(seed)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", call.Name, err)
+		}
+	}
+	return img, nil
+}
+
+// usableEffects drops the effects that would do nothing useful to img,
+// returning a note saying which were skipped and why. With on_inapplicable
+// set to "ignore" every effect is kept and there's no note.
+func usableEffects(img image.Image, calls []effectCall) ([]effectCall, string) {
+	if config.Effects.OnInapplicable == "ignore" {
+		return calls, ""
+	}
+
+	var usable []effectCall
+	var reasons []string
+	for _, call := range calls {
+		check := effects[call.Name].inapplicable
+		if check == nil {
+			usable = append(usable, call)
+			continue
+		}
+		if reason := check(img); reason != "" {
+			reasons = append(reasons, fmt.Sprintf("skipped %s since %s", call.Name, reason))
+			continue
+		}
+		usable = append(usable, call)
+	}
+
+	if len(reasons) == 0 {
+		return calls, ""
+	}
+	return usable, "I " + strings.Join(reasons, " and ") + "."
+}
+
+func alreadyGray(img image.Image) string {
+	if isGrayscale(img) {
+		return "the image is already grayscale"
+	}
+	return ""
+}
+
+func flatImage(img image.Image) string {
+	if uniformity(img) >= 0.99 {
+		return "a flat image has no edges to find"
+	}
+	return ""
+}
+
+// seedFor derives the effects seed from a mention's status ID, so the same
+// mention always gets the same "random" result while different ones differ.
+func seedFor(id mastodon.ID) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return int64(h.Sum64())
+}
+
+func fixedQuality(quality int) func([]string) (int, error) {
+	return func([]string) (int, error) { return quality, nil }
+}
+
+// floatArg parses the i-th argument, returning def when it wasn't given.
+func floatArg(args []string, i int, def, min, max float64) (float64, error) {
+	if i >= len(args) {
+		return def, nil
+	}
+	value, err := strconv.ParseFloat(args[i], 64)
+	if err != nil || value < min || value > max {
+		return 0, fmt.Errorf("%q should be a number between %g and %g", args[i], min, max)
+	}
+	return value, nil
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// crtEffect darkens every few rows into scanlines and pulls the red and blue
+// channels apart horizontally, like an old CRT.
+func crtEffect(img image.Image, args []string, rng *rand.Rand) (image.Image, error) {
+	cfg := config.Effects.CRT
+	darkness := cfg.ScanlineDarkness
+	if darkness == 0 {
+		darkness = 0.35
+	}
+	spacing := cfg.ScanlineSpacing
+	if spacing <= 0 {
+		spacing = 2
+	}
+	shift := cfg.Shift
+	if shift == 0 {
+		shift = 2
+	}
+
+	src := toRGBA(img)
+	b := src.Bounds()
+	out := image.NewRGBA(b)
+
+	for y := 0; y < b.Dy(); y++ {
+		brightness := 1.0
+		if y%spacing == spacing-1 {
+			brightness = 1 - darkness
+		}
+		for x := 0; x < b.Dx(); x++ {
+			r := src.RGBAAt(clampInt(x-shift, 0, b.Dx()-1), y).R
+			g := src.RGBAAt(x, y).G
+			bl := src.RGBAAt(clampInt(x+shift, 0, b.Dx()-1), y).B
+			out.SetRGBA(x, y, color.RGBA{
+				R: uint8(float64(r) * brightness),
+				G: uint8(float64(g) * brightness),
+				B: uint8(float64(bl) * brightness),
+				A: 255,
+			})
+		}
+	}
+
+	return out, nil
+}
+
+// aberrateEffect fakes lens fringing by pulling the red channel up and to the
+// left and the blue channel down and to the right. The optional argument is
+// the shift in pixels.
+func aberrateEffect(img image.Image, args []string, rng *rand.Rand) (image.Image, error) {
+	def := float64(config.Effects.Aberrate.Shift)
+	if def == 0 {
+		def = 4
+	}
+	shift, err := floatArg(args, 0, def, 1, 50)
+	if err != nil {
+		return nil, err
+	}
+	dx, dy := int(shift), int(shift)/2
+
+	src := toRGBA(img)
+	b := src.Bounds()
+	out := image.NewRGBA(b)
+	maxX, maxY := b.Dx()-1, b.Dy()-1
+
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			out.SetRGBA(x, y, color.RGBA{
+				R: src.RGBAAt(clampInt(x+dx, 0, maxX), clampInt(y+dy, 0, maxY)).R,
+				G: src.RGBAAt(x, y).G,
+				B: src.RGBAAt(clampInt(x-dx, 0, maxX), clampInt(y-dy, 0, maxY)).B,
+				A: 255,
+			})
+		}
+	}
+
+	return out, nil
+}
+
+// noiseEffect adds random noise before crunching, which JPEG makes a real
+// mess of. The optional argument is the intensity from 0 to 1; anything
+// outside that is clamped.
+func noiseEffect(img image.Image, args []string, rng *rand.Rand) (image.Image, error) {
+	intensity := 0.2
+	if len(args) > 0 {
+		value, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q should be a number between 0 and 1", args[0])
+		}
+		intensity = math.Max(0, math.Min(1, value))
+	}
+	amplitude := intensity * 255
+	colored := config.Effects.Noise.Color
+
+	src := toRGBA(img)
+	b := src.Bounds()
+	out := image.NewRGBA(b)
+
+	offset := func() float64 { return (rng.Float64()*2 - 1) * amplitude }
+	shift := func(v uint8, d float64) uint8 {
+		return uint8(clampInt(int(float64(v)+d), 0, 255))
+	}
+
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			p := src.RGBAAt(x, y)
+			dr := offset()
+			dg, db := dr, dr
+			if colored {
+				dg, db = offset(), offset()
+			}
+			out.SetRGBA(x, y, color.RGBA{R: shift(p.R, dr), G: shift(p.G, dg), B: shift(p.B, db), A: 255})
+		}
+	}
+
+	return out, nil
+}
+
+// filmEffect gives the image an analog look: gaussian grain, strongest in
+// the midtones like real film, and corners darkened by a vignette. The
+// arguments are the grain and vignette strengths, from 0 to 1.
+func filmEffect(img image.Image, args []string, rng *rand.Rand) (image.Image, error) {
+	grainDef, vignetteDef := config.Effects.Film.Grain, config.Effects.Film.Vignette
+	if grainDef == 0 && vignetteDef == 0 {
+		grainDef, vignetteDef = 0.12, 0.5
+	}
+	grain, err := floatArg(args, 0, grainDef, 0, 1)
+	if err != nil {
+		return nil, err
+	}
+	vignette, err := floatArg(args, 1, vignetteDef, 0, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	src := toRGBA(img)
+	b := src.Bounds()
+	out := image.NewRGBA(b)
+	cx, cy := float64(b.Dx())/2, float64(b.Dy())/2
+
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			p := src.RGBAAt(b.Min.X+x, b.Min.Y+y)
+
+			// Darken towards the corners, leaving the middle untouched.
+			d := math.Hypot((float64(x)-cx)/cx, (float64(y)-cy)/cy) / math.Sqrt2
+			t := math.Max(0, math.Min(1, (d-0.3)/0.7))
+			shade := 1 - vignette*t*t*(3-2*t)
+
+			luma := (0.299*float64(p.R) + 0.587*float64(p.G) + 0.114*float64(p.B)) / 255
+			noise := rng.NormFloat64() * grain * 255 * (0.4 + 2.4*luma*(1-luma))
+
+			tone := func(v uint8) uint8 {
+				return uint8(clampInt(int(float64(v)*shade+noise), 0, 255))
+			}
+			out.SetRGBA(x, y, color.RGBA{R: tone(p.R), G: tone(p.G), B: tone(p.B), A: 255})
+		}
+	}
+
+	return out, nil
+}
+
+// tileEffect splits the image into an n×n grid and crunches every tile at a
+// different random quality, so some regions survive and others are mush.
+func tileEffect(img image.Image, args []string, rng *rand.Rand) (image.Image, error) {
+	n, err := floatArg(args, 0, 3, 2, 10)
+	if err != nil {
+		return nil, err
+	}
+	grid := int(n)
+
+	src := toRGBA(img)
+	b := src.Bounds()
+	out := image.NewRGBA(b)
+
+	for row := 0; row < grid; row++ {
+		for col := 0; col < grid; col++ {
+			tile := image.Rect(b.Dx()*col/grid, b.Dy()*row/grid, b.Dx()*(col+1)/grid, b.Dy()*(row+1)/grid)
+			if tile.Empty() {
+				continue
+			}
+
+			crunched, err := crunchAt(src.SubImage(tile), 1+rng.Intn(60))
+			if err != nil {
+				return nil, err
+			}
+			draw.Draw(out, tile, crunched, crunched.Bounds().Min, draw.Src)
+		}
+	}
+
+	return out, nil
+}
+
+// maxPatternDimension caps the longest side of a "pattern" grid, however many
+// copies it's made of.
+const maxPatternDimension = 2048
+
+// patternEffect repeats the image in an n×n grid like wallpaper, shrinking
+// each copy so the whole grid stays within maxPatternDimension.
+func patternEffect(img image.Image, args []string, rng *rand.Rand) (image.Image, error) {
+	n, err := floatArg(args, 0, 3, 2, 8)
+	if err != nil {
+		return nil, err
+	}
+	grid := int(n)
+
+	b := img.Bounds()
+	tile := downscale(img, min(max(b.Dx(), b.Dy()), maxPatternDimension/grid))
+	tb := tile.Bounds()
+
+	out := image.NewRGBA(image.Rect(0, 0, tb.Dx()*grid, tb.Dy()*grid))
+	for row := 0; row < grid; row++ {
+		for col := 0; col < grid; col++ {
+			cell := image.Rect(col*tb.Dx(), row*tb.Dy(), (col+1)*tb.Dx(), (row+1)*tb.Dy())
+			draw.Draw(out, cell, tile, tb.Min, draw.Src)
+		}
+	}
+	return out, nil
+}
+
+// waveEffect ripples the image by shifting rows sideways and columns up and
+// down along sine waves, so it looks like it's melting. The optional arguments
+// are the amplitude in pixels and how many waves fit across the image.
+func waveEffect(img image.Image, args []string, rng *rand.Rand) (image.Image, error) {
+	cfg := config.Effects.Wave
+	defAmplitude := cfg.Amplitude
+	if defAmplitude == 0 {
+		defAmplitude = 8
+	}
+	defFrequency := cfg.Frequency
+	if defFrequency == 0 {
+		defFrequency = 3
+	}
+	amplitude, err := floatArg(args, 0, defAmplitude, 0, 100)
+	if err != nil {
+		return nil, err
+	}
+	frequency, err := floatArg(args, 1, defFrequency, 0.1, 50)
+	if err != nil {
+		return nil, err
+	}
+
+	src := toRGBA(img)
+	b := src.Bounds()
+	out := image.NewRGBA(b)
+	w, h := float64(b.Dx()), float64(b.Dy())
+
+	for y := 0; y < b.Dy(); y++ {
+		dx := amplitude * math.Sin(2*math.Pi*frequency*float64(y)/h)
+		for x := 0; x < b.Dx(); x++ {
+			dy := amplitude * math.Sin(2*math.Pi*frequency*float64(x)/w)
+			out.SetRGBA(x, y, sampleBilinear(src, float64(x)+dx, float64(y)+dy))
+		}
+	}
+
+	return out, nil
+}
+
+// sampleBilinear reads src at a fractional position, blending the four
+// nearest pixels. Positions outside the image are clamped to its edge.
+func sampleBilinear(src *image.RGBA, fx, fy float64) color.RGBA {
+	b := src.Bounds()
+	fx = math.Max(0, math.Min(fx, float64(b.Dx()-1)))
+	fy = math.Max(0, math.Min(fy, float64(b.Dy()-1)))
+
+	x0, y0 := int(fx), int(fy)
+	x1, y1 := min(x0+1, b.Dx()-1), min(y0+1, b.Dy()-1)
+	tx, ty := fx-float64(x0), fy-float64(y0)
+
+	p00, p10 := src.RGBAAt(x0, y0), src.RGBAAt(x1, y0)
+	p01, p11 := src.RGBAAt(x0, y1), src.RGBAAt(x1, y1)
+	mix := func(a, b, c, d uint8) uint8 {
+		top := float64(a)*(1-tx) + float64(b)*tx
+		bottom := float64(c)*(1-tx) + float64(d)*tx
+		return uint8(top*(1-ty) + bottom*ty + 0.5)
+	}
+	return color.RGBA{
+		R: mix(p00.R, p10.R, p01.R, p11.R),
+		G: mix(p00.G, p10.G, p01.G, p11.G),
+		B: mix(p00.B, p10.B, p01.B, p11.B),
+		A: 255,
+	}
+}
+
+// edgesEffect runs a Sobel edge detector over the image, leaving bright
+// outlines on black. The optional argument is how much of the original to
+// blend back in, from 0 to 1.
+func edgesEffect(img image.Image, args []string, rng *rand.Rand) (image.Image, error) {
+	blend, err := floatArg(args, 0, config.Effects.Edges.Blend, 0, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	src := toRGBA(img)
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	gray := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := src.RGBAAt(x, y)
+			gray[y*w+x] = 0.299*float64(p.R) + 0.587*float64(p.G) + 0.114*float64(p.B)
+		}
+	}
+	at := func(x, y int) float64 {
+		return gray[clampInt(y, 0, h-1)*w+clampInt(x, 0, w-1)]
+	}
+
+	edges := image.NewRGBA(b)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			gx := at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) -
+				at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+			gy := at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) -
+				at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+			v := uint8(clampInt(int(math.Hypot(gx, gy)), 0, 255))
+			edges.SetRGBA(x, y, color.RGBA{R: v, G: v, B: v, A: 255})
+		}
+	}
+
+	if blend == 0 {
+		return edges, nil
+	}
+	return blendMasked(edges, src, func(x, y int) float64 { return blend }), nil
+}
+
+// grayscaleEffect drains the colour out of the image.
+func grayscaleEffect(img image.Image, args []string, rng *rand.Rand) (image.Image, error) {
+	b := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(gray, gray.Bounds(), img, b.Min, draw.Src)
+	return gray, nil
+}
+
+// crunchAt round-trips img through JPEG at the given quality.
+func crunchAt(img image.Image, quality int) (image.Image, error) {
+	data, err := encodeJPEG(img, quality)
+	if err != nil {
+		return nil, err
+	}
+	crunched, _, err := decodeImage(data)
+	return crunched, err
+}
+
+// blendMasked mixes two same-sized images pixel by pixel, taking weight(x, y)
+// of heavy and the rest of light.
+func blendMasked(light, heavy image.Image, weight func(x, y int) float64) *image.RGBA {
+	l, h := toRGBA(light), toRGBA(heavy)
+	b := l.Bounds()
+	out := image.NewRGBA(b)
+
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			w := weight(x, y)
+			lp, hp := l.RGBAAt(x, y), h.RGBAAt(x, y)
+			out.SetRGBA(x, y, color.RGBA{
+				R: uint8(float64(lp.R)*(1-w) + float64(hp.R)*w + 0.5),
+				G: uint8(float64(lp.G)*(1-w) + float64(hp.G)*w + 0.5),
+				B: uint8(float64(lp.B)*(1-w) + float64(hp.B)*w + 0.5),
+				A: 255,
+			})
+		}
+	}
+	return out
+}
+
+// gradientEffect crunches the image harder and harder from left to right by
+// blending a light and an extreme crunch along a horizontal gradient. It
+// picks a high final quality so the gradient survives.
+func gradientEffect(img image.Image, args []string, rng *rand.Rand) (image.Image, error) {
+	light, err := crunchAt(img, 70)
+	if err != nil {
+		return nil, err
+	}
+	heavy, err := crunchAt(img, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	width := float64(img.Bounds().Dx() - 1)
+	if width < 1 {
+		width = 1
+	}
+	return blendMasked(light, heavy, func(x, y int) float64 {
+		return float64(x) / width
+	}), nil
+}
+
+// bgEffect crunches the background and keeps the subject sharp, guessing
+// that the subject is in the middle: a light crunch in the centre fades into
+// an extreme one towards the edges. The optional argument is the size of the
+// sharp centre from 0.1 to 0.9, as a fraction of the image. Like gradient, it
+// picks a high final quality so the difference survives.
+func bgEffect(img image.Image, args []string, rng *rand.Rand) (image.Image, error) {
+	radius, err := floatArg(args, 0, 0.35, 0.1, 0.9)
+	if err != nil {
+		return nil, err
+	}
+
+	light, err := crunchAt(img, 70)
+	if err != nil {
+		return nil, err
+	}
+	heavy, err := crunchAt(img, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	b := img.Bounds()
+	cx, cy := float64(b.Dx())/2, float64(b.Dy())/2
+	return blendMasked(light, heavy, func(x, y int) float64 {
+		// Distance from the centre with the image squashed into a circle,
+		// so 1 is the middle of an edge.
+		dx, dy := (float64(x)-cx)/cx, (float64(y)-cy)/cy
+		d := math.Hypot(dx, dy)
+		t := math.Max(0, math.Min(1, (d-radius)/(1-radius)))
+		return t * t * (3 - 2*t)
+	}), nil
+}
+
+// mirrorEffect reflects the left half of the image onto the right.
+func mirrorEffect(img image.Image, args []string, rng *rand.Rand) (image.Image, error) {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(out, out.Bounds(), img, b.Min, draw.Src)
+
+	w := b.Dx()
+	for y := 0; y < b.Dy(); y++ {
+		for x := w / 2; x < w; x++ {
+			out.SetRGBA(x, y, out.RGBAAt(w-1-x, y))
+		}
+	}
+	return out, nil
+}
+
+// kaleidoscopeEffect cuts a wedge out of the image around its centre and
+// repeats it, mirrored every other time, all the way round. The optional
+// argument is the number of wedges.
+func kaleidoscopeEffect(img image.Image, args []string, rng *rand.Rand) (image.Image, error) {
+	def := float64(config.Effects.Kaleidoscope.Segments)
+	if def == 0 {
+		def = 6
+	}
+	n, err := floatArg(args, 0, def, 2, 32)
+	if err != nil {
+		return nil, err
+	}
+	segment := 2 * math.Pi / math.Floor(n)
+
+	src := toRGBA(img)
+	b := src.Bounds()
+	out := image.NewRGBA(b)
+	cx, cy := float64(b.Dx())/2, float64(b.Dy())/2
+
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			dx, dy := float64(x)-cx, float64(y)-cy
+			r := math.Hypot(dx, dy)
+
+			// Fold the angle into the first wedge, reflecting alternate
+			// wedges so neighbours meet seamlessly.
+			angle := math.Mod(math.Atan2(dy, dx)+2*math.Pi, segment)
+			if angle > segment/2 {
+				angle = segment - angle
+			}
+
+			out.SetRGBA(x, y, sampleBilinear(src, cx+r*math.Cos(angle), cy+r*math.Sin(angle)))
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"testing"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// flatColor is a w×h image of a single colour.
+func flatColor(w, h int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func TestCRTGolden(t *testing.T) {
+	checkGolden(t, "crt", crunch(t, testImage(64, 48), "@bot crt quality 60"))
+}
+
+func TestCRTScanlines(t *testing.T) {
+	out, err := crtEffect(flatColor(8, 8, color.RGBA{200, 200, 200, 255}), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rgba := out.(*image.RGBA)
+	for y := 0; y < 8; y++ {
+		want := uint8(200)
+		if y%2 == 1 {
+			want = uint8(200 * (1 - 0.35))
+		}
+		if got := rgba.RGBAAt(4, y).G; got != want {
+			t.Errorf("row %d has brightness %d, want %d", y, got, want)
+		}
+	}
+}
+
+func TestTileMinefield(t *testing.T) {
+	img := testImage(61, 47)
+	apply := func(seed int64) image.Image {
+		out, err := applyEffects(img, []effectCall{{Name: "tile", Args: []string{"4"}}}, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	out := apply(1)
+	if out.Bounds() != img.Bounds() {
+		t.Fatalf("minefield is %v, want the original %v", out.Bounds(), img.Bounds())
+	}
+	res, err := compress(out, options{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := decodeImage(res.Data)
+	if err != nil || decoded.Bounds().Size() != img.Bounds().Size() {
+		t.Fatalf("crunched minefield decoded as %v, %v", decoded, err)
+	}
+
+	if meanDifference(out, apply(1)) != 0 {
+		t.Error("same seed gave a different minefield")
+	}
+	if meanDifference(out, apply(2)) == 0 {
+		t.Error("different seeds gave the same minefield")
+	}
+}
+
+func TestGradientGolden(t *testing.T) {
+	img := testImage(64, 48)
+	out, err := gradientEffect(img, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "gradient", out)
+
+	// The left edge is the light crunch and the right edge the heavy one.
+	light, _ := crunchAt(img, 70)
+	heavy, _ := crunchAt(img, 1)
+	left, right := image.Rect(0, 0, 1, 48), image.Rect(63, 0, 64, 48)
+	rgba := out.(*image.RGBA)
+	if d := meanDifference(rgba.SubImage(left), light.(subImager).SubImage(left)); d > 1 {
+		t.Errorf("left edge is %.2f off the light crunch", d)
+	}
+	if d := meanDifference(rgba.SubImage(right), heavy.(subImager).SubImage(right)); d > 1 {
+		t.Errorf("right edge is %.2f off the heavy crunch", d)
+	}
+}
+
+func TestAberrateGolden(t *testing.T) {
+	checkGolden(t, "aberrate", crunch(t, testImage(64, 48), "@bot aberrate 6 quality 60"))
+}
+
+func TestAberrateShiftsChannels(t *testing.T) {
+	// Red is read from down and to the right, so a single white pixel's
+	// red shows up and to the left of it, and its blue the other way.
+	img := image.NewRGBA(image.Rect(0, 0, 20, 20))
+	img.SetRGBA(10, 10, color.RGBA{255, 255, 255, 255})
+
+	out, err := aberrateEffect(img, []string{"4"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rgba := out.(*image.RGBA)
+	if got := rgba.RGBAAt(6, 8); got.R != 255 || got.B != 0 {
+		t.Errorf("red isn't shifted up and left: %v", got)
+	}
+	if got := rgba.RGBAAt(14, 12); got.B != 255 || got.R != 0 {
+		t.Errorf("blue isn't shifted down and right: %v", got)
+	}
+	if got := rgba.RGBAAt(10, 10); got.G != 255 || got.R != 0 || got.B != 0 {
+		t.Errorf("green moved: %v", got)
+	}
+}
+
+func TestNoiseDeterministic(t *testing.T) {
+	img := flatColor(32, 32, color.RGBA{128, 128, 128, 255})
+	noise := func(seed int64, colored bool) *image.RGBA {
+		withConfig(t, func(c *Config) { c.Effects.Noise.Color = colored })
+		out, err := applyEffects(img, []effectCall{{Name: "noise", Args: []string{"0.5"}}}, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out.(*image.RGBA)
+	}
+
+	first := noise(42, false)
+	if !bytes.Equal(first.Pix, noise(42, false).Pix) {
+		t.Error("the same seed gave different noise")
+	}
+	if bytes.Equal(first.Pix, noise(43, false).Pix) {
+		t.Error("different seeds gave the same noise")
+	}
+	if meanDifference(first, img) < 10 {
+		t.Error("noise at 0.5 barely changed the image")
+	}
+
+	// Monochrome grain moves every channel together; coloured noise doesn't.
+	p := first.RGBAAt(5, 5)
+	if p.R != p.G || p.G != p.B {
+		t.Errorf("monochrome noise gave a coloured pixel %v", p)
+	}
+	colored := noise(42, true)
+	gray := true
+	for i := 0; i < len(colored.Pix); i += 4 {
+		if colored.Pix[i] != colored.Pix[i+1] {
+			gray = false
+			break
+		}
+	}
+	if gray {
+		t.Error("coloured noise came out gray")
+	}
+}
+
+func TestSeedFromStatusID(t *testing.T) {
+	if seedFor("109876543210") != seedFor("109876543210") {
+		t.Fatal("the same status ID gave different seeds")
+	}
+	if seedFor("109876543210") == seedFor("109876543211") {
+		t.Fatal("different status IDs gave the same seed")
+	}
+
+	img := testImage(32, 32)
+	output := func(id string) []byte {
+		opts, err := parseOptions("@bot noise tile")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.Seed = seedFor(mastodon.ID(id))
+		res, err := processStill(img, opts, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Data
+	}
+	if !bytes.Equal(output("1"), output("1")) {
+		t.Error("the same mention gave different output")
+	}
+	if bytes.Equal(output("1"), output("2")) {
+		t.Error("different mentions gave the same output")
+	}
+}
+
+func TestWaveGolden(t *testing.T) {
+	checkGolden(t, "wave", crunch(t, testImage(64, 48), "@bot wave 5 2 quality 60"))
+
+	img := testImage(32, 32)
+	flat, err := waveEffect(img, []string{"0"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := meanDifference(flat, img); d != 0 {
+		t.Errorf("amplitude 0 moved the image by %.2f", d)
+	}
+	if _, err := waveEffect(img, []string{"500"}, nil); err == nil {
+		t.Error("amplitude 500 was accepted")
+	}
+}
+
+func TestEdgesOnHighContrast(t *testing.T) {
+	// Black on the left, white from column 16 on.
+	img := flatColor(32, 16, color.Black)
+	draw.Draw(img, image.Rect(16, 0, 32, 16), image.White, image.Point{}, draw.Src)
+
+	out, err := edgesEffect(img, []string{"0"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rgba := out.(*image.RGBA)
+	for y := 0; y < 16; y++ {
+		if got := rgba.RGBAAt(15, y).R; got != 255 {
+			t.Errorf("edge at (15, %d) is %d, want 255", y, got)
+		}
+		for _, x := range []int{4, 28} {
+			if got := rgba.RGBAAt(x, y).R; got != 0 {
+				t.Errorf("flat area at (%d, %d) is %d, want 0", x, y, got)
+			}
+		}
+	}
+
+	// Blending halfway brings back half the original on flat areas.
+	out, err = edgesEffect(img, []string{"0.5"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := out.(*image.RGBA).RGBAAt(28, 8).R; got < 120 || got > 135 {
+		t.Errorf("white area blended halfway is %d, want about 127", got)
+	}
+}
+
+func TestBackgroundGolden(t *testing.T) {
+	img := testImage(64, 48)
+	out, err := bgEffect(img, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "bg", out)
+
+	// The centre stays closer to the original than the corners do.
+	rgba := out.(*image.RGBA)
+	centre := image.Rect(24, 18, 40, 30)
+	corner := image.Rect(0, 0, 16, 12)
+	sharp := meanDifference(rgba.SubImage(centre), img.SubImage(centre))
+	crunched := meanDifference(rgba.SubImage(corner), img.SubImage(corner))
+	if sharp*2 > crunched {
+		t.Errorf("centre is %.2f off the original and the corner %.2f, want the centre much sharper", sharp, crunched)
+	}
+}
+
+func TestMirrorGolden(t *testing.T) {
+	img := testImage(64, 48)
+	out, err := mirrorEffect(img, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "mirror", out)
+
+	rgba := out.(*image.RGBA)
+	for y := 0; y < 48; y += 7 {
+		for x := 0; x < 32; x += 5 {
+			if rgba.RGBAAt(x, y) != img.RGBAAt(x, y) || rgba.RGBAAt(63-x, y) != img.RGBAAt(x, y) {
+				t.Fatalf("(%d, %d) isn't mirrored from the left half", 63-x, y)
+			}
+		}
+	}
+}
+
+func TestKaleidoscopeGolden(t *testing.T) {
+	checkGolden(t, "kaleidoscope", crunch(t, testImage(64, 64), "@bot kaleidoscope 6 quality 60"))
+
+	// Each wedge is mirrored into its neighbours, so points at opposite
+	// angles across a wedge boundary match.
+	out, err := kaleidoscopeEffect(testImage(64, 64), []string{"4"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rgba := out.(*image.RGBA)
+	for _, p := range []image.Point{{40, 36}, {50, 40}, {45, 33}} {
+		flipped := image.Pt(p.X, 64-p.Y)
+		if !sameColor(rgba.At(p.X, p.Y), rgba.At(flipped.X, flipped.Y)) {
+			t.Errorf("%v and %v aren't mirror images", p, flipped)
+		}
+	}
+}
+
+func TestInapplicableEffects(t *testing.T) {
+	parse := func(content string) options {
+		opts, err := parseOptions(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return opts
+	}
+
+	withConfig(t, func(c *Config) { c.Effects.OnInapplicable = "note" })
+	gray := flatColor(16, 16, color.Gray{128})
+	calls, note := usableEffects(gray, parse("@bot grayscale edges crt").Effects)
+	if len(calls) != 1 || calls[0].Name != "crt" {
+		t.Errorf("kept %v on a flat gray image, want just crt", calls)
+	}
+	if want := "I skipped grayscale since the image is already grayscale and skipped edges since a flat image has no edges to find."; note != want {
+		t.Errorf("note is %q, want %q", note, want)
+	}
+
+	// Effects that apply are kept without a note.
+	if calls, note := usableEffects(testImage(16, 16), parse("@bot grayscale edges").Effects); len(calls) != 2 || note != "" {
+		t.Errorf("on a colourful image kept %v with note %q", calls, note)
+	}
+
+	// The note reaches the reply.
+	d, err := decodeStage(encodePNG(t, gray), options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := encodeStage(d, parse("@bot grayscale"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(results[0].Note, "already grayscale") {
+		t.Errorf("result note %q doesn't say grayscale was skipped", results[0].Note)
+	}
+
+	withConfig(t, func(c *Config) { c.Effects.OnInapplicable = "ignore" })
+	if calls, note := usableEffects(gray, parse("@bot grayscale edges").Effects); len(calls) != 2 || note != "" {
+		t.Errorf("with ignore kept %v with note %q, want both and no note", calls, note)
+	}
+}
+
+func TestPatternGolden(t *testing.T) {
+	img := testImage(32, 24)
+	out, err := patternEffect(img, []string{"3"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "pattern", out)
+
+	// Every cell of the grid is a copy of the image.
+	if got := out.Bounds().Size(); got != image.Pt(96, 72) {
+		t.Fatalf("3x3 pattern of a 32x24 image is %v, want 96x72", got)
+	}
+	rgba := out.(*image.RGBA)
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			cell := image.Rect(col*32, row*24, (col+1)*32, (row+1)*24)
+			if d := meanDifference(rgba.SubImage(cell), img); d != 0 {
+				t.Errorf("cell (%d, %d) is %.2f off the image", col, row, d)
+			}
+		}
+	}
+
+	// Big images are shrunk so the grid stays in bounds.
+	big, err := patternEffect(image.NewRGBA(image.Rect(0, 0, 1600, 1200)), []string{"4"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := big.Bounds(); b.Dx() > maxPatternDimension || b.Dy() > maxPatternDimension {
+		t.Errorf("4x4 pattern of a 1600x1200 image is %v, over %dpx", b, maxPatternDimension)
+	}
+	if _, err := patternEffect(img, []string{"20"}, nil); err == nil {
+		t.Error("a 20x20 pattern was accepted")
+	}
+}
+
+func TestFilmDeterministic(t *testing.T) {
+	img := flatColor(48, 48, color.RGBA{128, 128, 128, 255})
+	film := func(seed int64, args ...string) *image.RGBA {
+		out, err := applyEffects(img, []effectCall{{Name: "film", Args: args}}, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out.(*image.RGBA)
+	}
+
+	first := film(7)
+	if !bytes.Equal(first.Pix, film(7).Pix) {
+		t.Error("the same seed gave different grain")
+	}
+	if bytes.Equal(first.Pix, film(8).Pix) {
+		t.Error("different seeds gave the same grain")
+	}
+
+	// Without grain only the vignette is left: the middle is untouched and
+	// the corners darkened.
+	clean := film(7, "0", "0.5")
+	if got := clean.RGBAAt(24, 24); got.R != 128 {
+		t.Errorf("middle of the vignette is %v, want it untouched", got)
+	}
+	if got := clean.RGBAAt(0, 0); got.R >= 80 {
+		t.Errorf("corner of the vignette is %v, want it darkened", got)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+// eraPreset bundles the knobs that make an image look like it was saved in a
+// particular year of the web.
+type eraPreset struct {
+	MaxDimension int // longest side, in pixels
+	Quality      int // final JPEG quality
+	Passes       int // extra JPEG round trips before the final crunch
+}
+
+var eraPresets = map[int]eraPreset{
+	1996: {MaxDimension: 320, Quality: 8, Passes: 3},
+	2000: {MaxDimension: 480, Quality: 15, Passes: 2},
+	2004: {MaxDimension: 640, Quality: 25, Passes: 2},
+	2010: {MaxDimension: 1024, Quality: 45, Passes: 1},
+}
+
+const defaultEra = 2004
+
+// lookupEra returns the preset for the latest era at or before the requested
+// year, so "era 2006" gets the 2004 look. Years before the first era get the
+// first one.
+func lookupEra(args []string) (eraPreset, error) {
+	year := defaultEra
+	if len(args) > 0 {
+		var err error
+		year, err = strconv.Atoi(args[0])
+		if err != nil {
+			return eraPreset{}, fmt.Errorf("%q isn't a year", args[0])
+		}
+	}
+
+	years := make([]int, 0, len(eraPresets))
+	for y := range eraPresets {
+		years = append(years, y)
+	}
+	sort.Ints(years)
+
+	chosen := years[0]
+	for _, y := range years {
+		if y <= year {
+			chosen = y
+		}
+	}
+	return eraPresets[chosen], nil
+}
+
+func eraQuality(args []string) (int, error) {
+	preset, err := lookupEra(args)
+	return preset.Quality, err
+}
+
+// eraEffect shrinks the image to the era's dimensions and runs it through a
+// few extra JPEG generations. The era's quality is applied by the final
+// crunch, see eraQuality.
+func eraEffect(img image.Image, args []string, rng *rand.Rand) (image.Image, error) {
+	preset, err := lookupEra(args)
+	if err != nil {
+		return nil, err
+	}
+
+	img = downscale(img, preset.MaxDimension)
+	for i := 0; i < preset.Passes; i++ {
+		img, err = crunchAt(img, preset.Quality)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestEraPresets(t *testing.T) {
+	tests := []struct {
+		args []string
+		want eraPreset
+	}{
+		{nil, eraPresets[2004]},
+		{[]string{"1996"}, eraPreset{MaxDimension: 320, Quality: 8, Passes: 3}},
+		{[]string{"2000"}, eraPreset{MaxDimension: 480, Quality: 15, Passes: 2}},
+		{[]string{"2004"}, eraPreset{MaxDimension: 640, Quality: 25, Passes: 2}},
+		{[]string{"2010"}, eraPreset{MaxDimension: 1024, Quality: 45, Passes: 1}},
+		{[]string{"2006"}, eraPresets[2004]},
+		{[]string{"1980"}, eraPresets[1996]},
+		{[]string{"2030"}, eraPresets[2010]},
+	}
+	for _, tt := range tests {
+		got, err := lookupEra(tt.args)
+		if err != nil {
+			t.Errorf("era %v: %v", tt.args, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("era %v is %+v, want %+v", tt.args, got, tt.want)
+		}
+	}
+
+	if _, err := lookupEra([]string{"soon"}); err == nil {
+		t.Error("era soon parsed without an error")
+	}
+}
+
+func TestEraAppliesPreset(t *testing.T) {
+	opts, err := parseOptions("@bot era 1996")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Quality != 8 {
+		t.Errorf("era 1996 crunches at quality %d, want 8", opts.Quality)
+	}
+	if opts, _ := parseOptions("@bot era 1996 quality 50"); opts.Quality != 50 {
+		t.Errorf("explicit quality was overridden to %d", opts.Quality)
+	}
+
+	out, err := eraEffect(testImage(800, 400), []string{"1996"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := out.Bounds().Size(); got.X != 320 || got.Y != 160 {
+		t.Errorf("era 1996 image is %v, want 320×160", got)
+	}
+}
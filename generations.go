@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"log"
+)
+
+const (
+	defaultGenerations = 10
+	maxGenerations     = 50
+
+	// Progressions have a frame per generation, so they're kept small.
+	maxProgressionDimension = 640
+
+	// Each generation shows for 0.3s and the last one lingers for 2s.
+	generationDelay     = 30
+	lastGenerationDelay = 200
+)
+
+// progressionEncoders turn the generations of a crunch into something
+// playable, keyed by progression_format. Builds with the mp4 tag register
+// "mp4" alongside the GIF encoder that's always available.
+var progressionEncoders = map[string]func(frames []image.Image) (result, error){
+	"gif": encodeProgressionGIF,
+}
+
+// crunchGenerations re-crunches an image over and over, like a meme saved and
+// reposted too many times, and renders every generation as one animation.
+func crunchGenerations(original image.Image, opts options) (result, error) {
+	img, err := prepareImage(original, opts)
+	if err != nil {
+		return result{}, err
+	}
+	img = downscale(img, maxProgressionDimension)
+
+	frames := []image.Image{img}
+	for i := 0; i < opts.Generations; i++ {
+		img, err = crunchAt(img, opts.quality())
+		if err != nil {
+			return result{}, fmt.Errorf("generation %d: %w", i+1, err)
+		}
+		frames = append(frames, img)
+	}
+
+	if opts.GenerationCounter {
+		for i, frame := range frames {
+			frames[i], err = drawLabel(frame, fmt.Sprintf("gen %d/%d", i, opts.Generations))
+			if err != nil {
+				return result{}, err
+			}
+		}
+	}
+
+	format := config.Image.ProgressionFormat
+	if format == "" {
+		format = "gif"
+	}
+	encode, ok := progressionEncoders[format]
+	if ok && supportedMimeTypes != nil && !supportedMimeTypes[formatMimeTypes[format]] {
+		ok = false
+	}
+	if !ok {
+		log.Printf("Can't render progressions as %s, using gif", format)
+		return encodeProgressionGIF(frames)
+	}
+
+	res, err := encode(frames)
+	if err != nil && format != "gif" {
+		log.Printf("Error rendering progression as %s, using gif: %v", format, err)
+		return encodeProgressionGIF(frames)
+	}
+	return res, err
+}
+
+func encodeProgressionGIF(frames []image.Image) (result, error) {
+	out := &gif.GIF{}
+	for i, frame := range frames {
+		delay := generationDelay
+		if i == len(frames)-1 {
+			delay = lastGenerationDelay
+		}
+		out.Image = append(out.Image, toPaletted(frame))
+		out.Delay = append(out.Delay, delay)
+		out.Disposal = append(out.Disposal, gif.DisposalNone)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, out); err != nil {
+		return result{}, fmt.Errorf("error encoding gif: %w", err)
+	}
+	return result{Data: buf.Bytes(), Format: "gif"}, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"testing"
+)
+
+func TestProgressionFallsBackToGIF(t *testing.T) {
+	img := testImage(32, 24)
+	opts := options{Generations: 3}
+	withConfig(t, func(c *Config) { c.Image.ProgressionFormat = "mp4" })
+
+	check := func(name string) {
+		t.Helper()
+		res, err := crunchGenerations(img, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if res.Format != "gif" {
+			t.Fatalf("%s: progression is %q, want gif", name, res.Format)
+		}
+		g, err := gif.DecodeAll(bytes.NewReader(res.Data))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(g.Image) != 4 {
+			t.Errorf("%s: %d frames, want the original and 3 generations", name, len(g.Image))
+		}
+	}
+
+	// Without the mp4 build tag there's no encoder at all.
+	saved, registered := progressionEncoders["mp4"]
+	delete(progressionEncoders, "mp4")
+	t.Cleanup(func() {
+		delete(progressionEncoders, "mp4")
+		if registered {
+			progressionEncoders["mp4"] = saved
+		}
+	})
+	check("no encoder")
+
+	// With the tag but no working ffmpeg, the encoder fails.
+	progressionEncoders["mp4"] = func([]image.Image) (result, error) {
+		return result{}, errors.New("ffmpeg isn't installed")
+	}
+	check("failing encoder")
+}
+
+func TestGenerationCounter(t *testing.T) {
+	var captured [][]image.Image
+	saved := progressionEncoders["gif"]
+	t.Cleanup(func() { progressionEncoders["gif"] = saved })
+	progressionEncoders["gif"] = func(frames []image.Image) (result, error) {
+		captured = append(captured, frames)
+		return saved(frames)
+	}
+	withConfig(t, func(c *Config) { c.Image.ProgressionFormat = "gif" })
+
+	img := testImage(96, 64)
+	for _, content := range []string{"@bot generations 4", "@bot generations 4 counter"} {
+		opts, err := parseOptions(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := crunchGenerations(img, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	plain, counted := captured[0], captured[1]
+	if len(counted) != 5 {
+		t.Fatalf("%d frames, want the original and 4 generations", len(counted))
+	}
+
+	// Every frame carries its own number, and not its neighbour's.
+	for i, frame := range counted {
+		want, err := drawLabel(plain[i], fmt.Sprintf("gen %d/4", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := meanDifference(frame, want); d != 0 {
+			t.Errorf("frame %d is %.2f off one labelled gen %d/4", i+1, d, i)
+		}
+		if meanDifference(frame, plain[i]) == 0 {
+			t.Errorf("frame %d has no counter", i+1)
+		}
+		wrong, _ := drawLabel(plain[i], fmt.Sprintf("gen %d/4", (i+1)%5))
+		if meanDifference(frame, wrong) == 0 {
+			t.Errorf("frame %d looks the same as one labelled gen %d/4", i+1, (i+1)%5)
+		}
+	}
+}
@@ -5,12 +5,12 @@ go 1.21.11
 require (
 	github.com/BurntSushi/toml v1.4.0
 	github.com/mattn/go-mastodon v0.0.8
+	golang.org/x/image v0.21.0
 )
 
 require (
 	github.com/gorilla/websocket v1.5.1 // indirect
 	github.com/tomnomnom/linkheader v0.0.0-20180905144013-02ca5825eb80 // indirect
-	golang.org/x/image v0.21.0 // indirect
 	golang.org/x/net v0.25.0 // indirect
 	golang.org/x/text v0.19.0 // indirect
 )
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-mastodon"
+)
+
+var formatMimeTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"mp4":  "video/mp4",
+}
+
+// supportedMimeTypes is the set of media types the instance accepts, or nil
+// if it didn't say, in which case everything is assumed to be accepted.
+var supportedMimeTypes map[string]bool
+
+// loadSupportedMimeTypes asks the instance which media types it accepts.
+// Older instances don't advertise them, which is fine.
+func loadSupportedMimeTypes(client *mastodon.Client) {
+	instance, err := client.GetInstance(ctx)
+	if err != nil {
+		log.Printf("Error fetching instance info: %v", err)
+		return
+	}
+	if instance.Configuration == nil {
+		return
+	}
+
+	types, ok := instance.Configuration.MediaAttachments["supported_mime_types"].([]interface{})
+	if !ok {
+		return
+	}
+
+	supportedMimeTypes = make(map[string]bool)
+	for _, t := range types {
+		if s, ok := t.(string); ok {
+			supportedMimeTypes[s] = true
+		}
+	}
+}
+
+// accountDomain returns the domain of an account's instance, or "" for
+// accounts local to ours.
+func accountDomain(acct string) string {
+	_, domain, _ := strings.Cut(acct, "@")
+	return strings.ToLower(domain)
+}
+
+// domainAccepts reports whether the configured format restrictions for
+// domain allow format. Domains without restrictions accept everything.
+func domainAccepts(domain, format string) bool {
+	for configured, formats := range config.Image.DomainFormats {
+		if !strings.EqualFold(configured, domain) {
+			continue
+		}
+		for _, allowed := range formats {
+			if outputFormats[strings.ToLower(allowed)] == format || strings.EqualFold(allowed, format) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// ensureSupportedFormat re-encodes res as a JPEG if our instance doesn't
+// accept its format, or if domain_formats says the requester's instance
+// (domain) doesn't. JPEG is accepted everywhere.
+func ensureSupportedFormat(res result, domain string) (result, error) {
+	if res.Format == "jpeg" {
+		return res, nil
+	}
+	instanceAccepts := supportedMimeTypes == nil || supportedMimeTypes[formatMimeTypes[res.Format]]
+	if instanceAccepts && domainAccepts(domain, res.Format) {
+		return res, nil
+	}
+
+	note := fmt.Sprintf("This instance doesn't accept %s uploads, so it's a JPEG.", formatMimeTypes[res.Format])
+	if instanceAccepts {
+		log.Printf("%s is restricted from %s output, converting to jpeg", domain, res.Format)
+		note = fmt.Sprintf("Your instance doesn't take %s, so it's a JPEG.", formatMimeTypes[res.Format])
+	} else {
+		log.Printf("Instance doesn't accept %s uploads, converting to jpeg", res.Format)
+	}
+
+	img, _, err := decodeImage(res.Data)
+	if err != nil {
+		return result{}, fmt.Errorf("error decoding %s for conversion: %w", res.Format, err)
+	}
+	data, err := encodeJPEG(img, 95)
+	if err != nil {
+		return result{}, err
+	}
+
+	converted := result{Data: data, Format: "jpeg", Note: res.Note, Description: res.Description, Sensitive: res.Sensitive}
+	converted.addNote(note)
+	return converted, nil
+}
+
+var formatExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"gif":  ".gif",
+	"mp4":  ".mp4",
+}
+
+// uploadResult uploads an encoded image. Uploads from a reader go out with a
+// generic filename, leaving the instance to work out the type from the bytes;
+// instances that won't are retried with a file named after the format.
+// Instances that insist on knowing the length are fine either way, since
+// go-mastodon buffers the whole multipart body and so always sends a
+// Content-Length.
+func uploadResult(client *mastodon.Client, res result) (*mastodon.Attachment, error) {
+	if detected := http.DetectContentType(res.Data); detected != formatMimeTypes[res.Format] {
+		return nil, fmt.Errorf("the encoded %s looks like %s", res.Format, detected)
+	}
+
+	media, err := client.UploadMediaFromMedia(ctx, &mastodon.Media{File: bytes.NewReader(res.Data), Description: res.Description})
+	var apiErr *mastodon.APIError
+	if !errors.As(err, &apiErr) ||
+		(apiErr.StatusCode != http.StatusUnprocessableEntity && apiErr.StatusCode != http.StatusUnsupportedMediaType) {
+		return media, err
+	}
+
+	log.Printf("Instance rejected %s upload (%v), retrying with a filename", res.Format, err)
+
+	f, err := os.CreateTemp("", "jpeg-bot-*"+formatExtensions[res.Format])
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(res.Data); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return client.UploadMediaFromMedia(ctx, &mastodon.Media{File: f, Description: res.Description})
+}
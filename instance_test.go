@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// withSupportedMimeTypes pretends the instance only accepts types, or
+// everything if types is nil.
+func withSupportedMimeTypes(t *testing.T, types ...string) {
+	t.Helper()
+	saved := supportedMimeTypes
+	t.Cleanup(func() { supportedMimeTypes = saved })
+	supportedMimeTypes = nil
+	if types != nil {
+		supportedMimeTypes = make(map[string]bool)
+		for _, mimeType := range types {
+			supportedMimeTypes[mimeType] = true
+		}
+	}
+}
+
+func TestLoadSupportedMimeTypes(t *testing.T) {
+	f, client := newFakeInstance(t)
+	withSupportedMimeTypes(t)
+	f.handle(http.MethodGet, "/api/v1/instance", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"uri": "example.com",
+			"configuration": map[string]any{
+				"media_attachments": map[string]any{
+					"supported_mime_types": []string{"image/jpeg", "image/gif"},
+				},
+			},
+		})
+	})
+
+	loadSupportedMimeTypes(client)
+	if !supportedMimeTypes["image/jpeg"] || !supportedMimeTypes["image/gif"] || supportedMimeTypes["image/png"] {
+		t.Errorf("supported types are %v, want jpeg and gif", supportedMimeTypes)
+	}
+}
+
+func TestUnsupportedFormatFallsBack(t *testing.T) {
+	png := result{Data: encodePNG(t, testImage(16, 16)), Format: "png", Note: "Original note.", Description: "alt"}
+
+	withSupportedMimeTypes(t, "image/jpeg", "image/png")
+	if res, err := ensureSupportedFormat(png, ""); err != nil || res.Format != "png" {
+		t.Errorf("supported png came back as %q, %v", res.Format, err)
+	}
+
+	withSupportedMimeTypes(t, "image/jpeg")
+	res, err := ensureSupportedFormat(png, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Format != "jpeg" || http.DetectContentType(res.Data) != "image/jpeg" {
+		t.Errorf("unsupported png came back as %q (%s), want a jpeg", res.Format, http.DetectContentType(res.Data))
+	}
+	if !strings.HasPrefix(res.Note, "Original note.") || !strings.Contains(res.Note, "doesn't accept image/png") {
+		t.Errorf("note is %q, want the original note and the conversion", res.Note)
+	}
+	if res.Description != "alt" {
+		t.Errorf("description %q was lost in the conversion", res.Description)
+	}
+
+	// Without any list from the instance, everything is accepted.
+	withSupportedMimeTypes(t)
+	if res, _ := ensureSupportedFormat(png, ""); res.Format != "png" {
+		t.Errorf("png was converted with no supported types known")
+	}
+}
+
+func TestUploadRetriesWithFilename(t *testing.T) {
+	f, client := newFakeInstance(t)
+
+	var filenames []string
+	f.handle(http.MethodPost, "/api/v1/media", func(w http.ResponseWriter, r *http.Request) {
+		_, header, err := r.FormFile("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		filenames = append(filenames, header.Filename)
+		if !strings.HasSuffix(header.Filename, ".png") {
+			http.Error(w, `{"error":"Validation failed: File content type is invalid"}`, http.StatusUnprocessableEntity)
+			return
+		}
+		writeJSON(w, mastodon.Attachment{ID: "m1", Type: "image"})
+	})
+
+	media, err := uploadResult(client, result{Data: encodePNG(t, testImage(8, 8)), Format: "png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if media.ID != "m1" {
+		t.Errorf("got media %q", media.ID)
+	}
+	if len(filenames) != 2 || filenames[0] != "upload" || !strings.HasSuffix(filenames[1], ".png") {
+		t.Errorf("uploaded as %q, want a generic name then one ending in .png", filenames)
+	}
+}
+
+func TestUploadOtherErrorsNotRetried(t *testing.T) {
+	f, client := newFakeInstance(t)
+	requests := 0
+	f.handle(http.MethodPost, "/api/v1/media", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, `{"error":"too big"}`, http.StatusRequestEntityTooLarge)
+	})
+
+	if _, err := uploadResult(client, jpegResult(t)); err == nil {
+		t.Error("failed upload returned no error")
+	}
+	if requests != 1 {
+		t.Errorf("made %d upload requests, want 1", requests)
+	}
+}
+
+func TestUploadRejectsMislabelledData(t *testing.T) {
+	_, client := newFakeInstance(t)
+	if _, err := uploadResult(client, result{Data: encodePNG(t, testImage(8, 8)), Format: "jpeg"}); err == nil {
+		t.Error("PNG data labelled as a JPEG was uploaded")
+	}
+}
+
+func TestDomainFormatRestrictions(t *testing.T) {
+	f, client := newFakeInstance(t)
+	withSupportedMimeTypes(t)
+	withConfig(t, func(c *Config) {
+		c.Image.DomainFormats = map[string][]string{"old.example.com": {"jpg"}}
+	})
+
+	for i, tt := range []struct {
+		acct, want string
+	}{
+		{"alice@old.example.com", "image/jpeg"},
+		{"bob@OLD.example.com", "image/jpeg"},
+		{"carol@new.example.com", "image/png"},
+		{"dave", "image/png"},
+	} {
+		notification := imageMention(t, f, fmt.Sprint(i+1), "<p>@bot format png</p>", 1)
+		notification.Account.Acct = tt.acct
+		handleMention(client, notification)
+
+		uploads, posts := f.uploaded(), f.posted()
+		if got := http.DetectContentType(uploads[len(uploads)-1]); got != tt.want {
+			t.Errorf("%s got %s, want %s", tt.acct, got, tt.want)
+		}
+		restricted := strings.Contains(posts[len(posts)-1].Get("status"), "Your instance doesn't take image/png")
+		if restricted != (tt.want == "image/jpeg") {
+			t.Errorf("%s got reply %q", tt.acct, posts[len(posts)-1].Get("status"))
+		}
+	}
+}
+
+func TestUploadsSendContentLength(t *testing.T) {
+	f, client := newFakeInstance(t)
+
+	// Reject the first attempt, so the retry from a file is checked too.
+	var mu sync.Mutex
+	var lengths []int64
+	f.handle(http.MethodPost, "/api/v1/media", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if len(r.TransferEncoding) > 0 || r.ContentLength != int64(len(body)) {
+			http.Error(w, `{"error":"Length Required"}`, http.StatusLengthRequired)
+			return
+		}
+		mu.Lock()
+		lengths = append(lengths, r.ContentLength)
+		first := len(lengths) == 1
+		mu.Unlock()
+		if first {
+			http.Error(w, `{"error":"Validation failed: File content type is invalid"}`, http.StatusUnprocessableEntity)
+			return
+		}
+		writeJSON(w, mastodon.Attachment{ID: "m1", Type: "image"})
+	})
+
+	if _, err := uploadResult(client, result{Data: encodePNG(t, testImage(8, 8)), Format: "png"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(lengths) != 2 {
+		t.Errorf("%d uploads came with a Content-Length, want both", len(lengths))
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// standardLuminance is the example luminance quantization table from the
+// JPEG spec (Annex K), which libjpeg and the standard library scale to get
+// every quality's table. It's in zigzag order, like tables in a file.
+var standardLuminance = [64]int{
+	16, 11, 12, 14, 12, 10, 16, 14,
+	13, 14, 18, 17, 16, 19, 24, 40,
+	26, 24, 22, 22, 24, 49, 35, 37,
+	29, 40, 58, 51, 61, 60, 57, 51,
+	56, 55, 64, 72, 92, 78, 64, 68,
+	87, 69, 55, 56, 80, 109, 81, 87,
+	95, 98, 103, 104, 103, 62, 77, 113,
+	121, 112, 100, 120, 92, 101, 103, 99,
+}
+
+var errAlreadyCrunched = errors.New("already crunched")
+
+// estimateJPEGQuality guesses the quality a JPEG was saved at by comparing
+// its luminance quantization table with the standard one. Encoders with
+// their own tables give rougher answers, but the order of magnitude holds.
+func estimateJPEGQuality(data []byte) (int, bool) {
+	if !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return 0, false
+	}
+
+	for i := 2; i+2 <= len(data); {
+		if data[i] != 0xff {
+			return 0, false
+		}
+		marker := data[i+1]
+		// Fill bytes and markers that stand alone, without a length.
+		if marker == 0xff {
+			i++
+			continue
+		}
+		if marker == 0x01 || marker == 0xd8 || (marker >= 0xd0 && marker <= 0xd7) {
+			i += 2
+			continue
+		}
+		if marker == markerSOS || i+4 > len(data) {
+			return 0, false
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 0, false
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xdb {
+			for len(segment) > 0 {
+				precision, id := segment[0]>>4, segment[0]&0x0f
+				size := 64 * (1 + int(precision))
+				if len(segment) < 1+size {
+					return 0, false
+				}
+				if id == 0 {
+					return qualityFromTable(segment[1:1+size], precision == 1), true
+				}
+				segment = segment[1+size:]
+			}
+		}
+		i += 2 + length
+	}
+	return 0, false
+}
+
+func qualityFromTable(table []byte, wide bool) int {
+	sum, standard := 0, 0
+	for i := 0; i < 64; i++ {
+		v := int(table[i])
+		if wide {
+			v = int(binary.BigEndian.Uint16(table[2*i:]))
+		}
+		// Very low qualities push entries up against the 8-bit limit,
+		// where they stop saying anything about the scale.
+		if v >= 255 {
+			continue
+		}
+		sum += v
+		standard += standardLuminance[i]
+	}
+	if standard == 0 {
+		return 1
+	}
+
+	// Tables are the standard one scaled by 5000/q percent below quality
+	// 50 and by 200-2q percent above it.
+	scale := float64(sum) * 100 / float64(standard)
+	var quality float64
+	if scale <= 100 {
+		quality = (200 - scale) / 2
+	} else {
+		quality = 5000 / scale
+	}
+	return clampInt(int(quality+0.5), 1, 100)
+}
+
+// alreadyCrunchedNote handles a source JPEG that's already at or below the
+// quality it's about to be crunched at, per already_crunched: it returns a
+// note saying so, or errAlreadyCrunched to skip it.
+func alreadyCrunchedNote(d decodedImage, opts options) (string, error) {
+	if d.sourceQuality == 0 || d.sourceQuality > opts.quality() || config.Image.AlreadyCrunched == "ignore" {
+		return "", nil
+	}
+	// Size targets pick their own quality, so there's nothing to compare.
+	if opts.budget(d.originalLength) > 0 {
+		return "", nil
+	}
+	// Effects and captions still change the image, whatever its quality.
+	if len(opts.Effects) > 0 || opts.CaptionTop != "" || opts.CaptionBottom != "" || opts.Generations > 0 || opts.RestartRows > 0 {
+		return "", nil
+	}
+	if config.Image.AlreadyCrunched == "skip" {
+		return "", errAlreadyCrunched
+	}
+	return fmt.Sprintf("This JPEG was already saved at about quality %d, so crunching it at %d doesn't change much.",
+		d.sourceQuality, opts.quality()), nil
+}
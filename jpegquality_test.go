@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEstimateJPEGQuality(t *testing.T) {
+	img := testImage(32, 32)
+	for _, q := range []int{3, 10, 25, 50, 75, 90, 100} {
+		got, ok := estimateJPEGQuality(encodeJPEGData(t, img, q))
+		if !ok {
+			t.Fatalf("no quality found in a quality %d JPEG", q)
+		}
+		if got < q-1 || got > q+1 {
+			t.Errorf("quality %d JPEG estimated at %d", q, got)
+		}
+	}
+
+	if _, ok := estimateJPEGQuality(encodePNG(t, img)); ok {
+		t.Error("found a JPEG quality in a PNG")
+	}
+}
+
+func TestAlreadyCrunched(t *testing.T) {
+	source := encodeJPEGData(t, testImage(32, 32), 10)
+	d, err := decodeStage(source, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parse := func(content string) options {
+		opts, err := parseOptions(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return opts
+	}
+
+	withConfig(t, func(c *Config) { c.Image.AlreadyCrunched = "note" })
+	if note, err := alreadyCrunchedNote(d, parse("@bot quality 20")); err != nil || !strings.Contains(note, "about quality 10") {
+		t.Errorf("crunching a quality 10 JPEG at 20 gave note %q, %v", note, err)
+	}
+	if note, _ := alreadyCrunchedNote(d, parse("@bot quality 5")); note != "" {
+		t.Errorf("crunching a quality 10 JPEG at 5 gave note %q", note)
+	}
+
+	withConfig(t, func(c *Config) { c.Image.AlreadyCrunched = "skip" })
+	if _, err := alreadyCrunchedNote(d, parse("@bot quality 20")); !errors.Is(err, errAlreadyCrunched) {
+		t.Errorf("skip gave %v, want errAlreadyCrunched", err)
+	}
+	// Size targets and effects aren't checked, since they still change
+	// the image.
+	for _, content := range []string{"@bot quality 20 size 50%", "@bot quality 20 crt"} {
+		if note, err := alreadyCrunchedNote(d, parse(content)); note != "" || err != nil {
+			t.Errorf("%q gave note %q, %v; want no check", content, note, err)
+		}
+	}
+
+	withConfig(t, func(c *Config) { c.Image.AlreadyCrunched = "ignore" })
+	if note, err := alreadyCrunchedNote(d, parse("@bot quality 20")); note != "" || err != nil {
+		t.Errorf("ignore gave note %q, %v", note, err)
+	}
+}
+
+func TestEstimateJPEGQualityMalformed(t *testing.T) {
+	valid := encodeJPEGData(t, testImage(16, 16), 50)
+
+	// Standalone markers and fill bytes after SOI are stepped over.
+	padded := append([]byte{0xff, 0xd8, 0xff, 0xd0, 0xff, 0xff}, valid[2:]...)
+	if q, ok := estimateJPEGQuality(padded); !ok || q < 49 || q > 51 {
+		t.Errorf("JPEG with a stray RST and fill byte estimated at %d, %v", q, ok)
+	}
+
+	for name, data := range map[string][]byte{
+		"stray marker":     append([]byte{0xff, 0xd8, 0xff, 0xd0, 0x00, 0x00}, valid[2:]...),
+		"length under 2":   append([]byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x01}, valid[2:]...),
+		"segment past end": {0xff, 0xd8, 0xff, 0xdb, 0x01, 0x00, 0x00},
+		"truncated marker": {0xff, 0xd8, 0xff},
+		"truncated length": {0xff, 0xd8, 0xff, 0xdb, 0x00},
+	} {
+		if q, ok := estimateJPEGQuality(data); ok {
+			t.Errorf("%s estimated at %d, want unknown", name, q)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+
+	"golang.org/x/image/draw"
+)
+
+const maxCompositeCell = 1024
+
+var compositeBackground = color.RGBA{R: 32, G: 32, B: 32, A: 255}
+
+// fitRect returns the largest rectangle with src's aspect ratio that fits
+// centred inside cell, so composites letterbox images instead of stretching
+// them.
+func fitRect(src, cell image.Rectangle) image.Rectangle {
+	sw, sh := src.Dx(), src.Dy()
+	cw, ch := cell.Dx(), cell.Dy()
+	if sw == 0 || sh == 0 || cw == 0 || ch == 0 {
+		return image.Rectangle{Min: cell.Min, Max: cell.Min}
+	}
+
+	w, h := cw, sh*cw/sw
+	if h > ch {
+		w, h = sw*ch/sh, ch
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	x := cell.Min.X + (cw-w)/2
+	y := cell.Min.Y + (ch-h)/2
+	return image.Rect(x, y, x+w, y+h)
+}
+
+// cellSize picks a cell big enough for img without exceeding
+// maxCompositeCell on either side.
+func cellSize(img image.Image) image.Point {
+	b := img.Bounds()
+	if b.Dx() <= maxCompositeCell && b.Dy() <= maxCompositeCell {
+		return b.Size()
+	}
+	return fitRect(b, image.Rect(0, 0, maxCompositeCell, maxCompositeCell)).Size()
+}
+
+// downscale shrinks img so its longest side is at most maxDimension,
+// preserving the aspect ratio. Smaller images are returned as they are.
+func downscale(img image.Image, maxDimension int) image.Image {
+	b := img.Bounds()
+	if b.Dx() <= maxDimension && b.Dy() <= maxDimension {
+		return img
+	}
+
+	scaled := image.NewRGBA(fitRect(b, image.Rect(0, 0, maxDimension, maxDimension)))
+	draw.ApproxBiLinear.Scale(scaled, scaled.Bounds(), img, b, draw.Src, nil)
+	return scaled
+}
+
+// drawFitted scales img into cell on dst, preserving its aspect ratio.
+func drawFitted(dst draw.Image, cell image.Rectangle, img image.Image) {
+	draw.ApproxBiLinear.Scale(dst, fitRect(img.Bounds(), cell), img, img.Bounds(), draw.Over, nil)
+}
+
+// compareComposite lays the original and the crunched image out side by
+// side. The composite is encoded losslessly so the original side stays
+// pristine.
+func compareComposite(original image.Image, crunched result) (result, error) {
+	crunchedImg, _, err := decodeImage(crunched.Data)
+	if err != nil {
+		return result{}, fmt.Errorf("error decoding crunched image: %w", err)
+	}
+
+	cell := cellSize(original)
+	canvas := image.NewRGBA(image.Rect(0, 0, cell.X*2, cell.Y))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(compositeBackground), image.Point{}, draw.Src)
+
+	drawFitted(canvas, image.Rect(0, 0, cell.X, cell.Y), original)
+	drawFitted(canvas, image.Rect(cell.X, 0, cell.X*2, cell.Y), crunchedImg)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas); err != nil {
+		return result{}, fmt.Errorf("error encoding comparison: %w", err)
+	}
+	return result{Data: buf.Bytes(), Format: "png", Note: crunched.Note}, nil
+}
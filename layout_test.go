@@ -0,0 +1,53 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func TestFitRect(t *testing.T) {
+	cell := image.Rect(0, 0, 100, 100)
+	tests := []struct {
+		name string
+		src  image.Rectangle
+		want image.Rectangle
+	}{
+		{"portrait", image.Rect(0, 0, 50, 200), image.Rect(37, 0, 62, 100)},
+		{"landscape", image.Rect(0, 0, 400, 100), image.Rect(0, 37, 100, 62)},
+		{"square", image.Rect(0, 0, 30, 30), image.Rect(0, 0, 100, 100)},
+		{"empty", image.Rect(0, 0, 0, 10), image.Rect(0, 0, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fitRect(tt.src, cell); got != tt.want {
+				t.Errorf("fitRect(%v) = %v, want %v", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFitRectOffsetCell(t *testing.T) {
+	got := fitRect(image.Rect(0, 0, 200, 100), image.Rect(100, 0, 200, 100))
+	if want := image.Rect(100, 25, 200, 75); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCompareCompositeKeepsAspectRatio(t *testing.T) {
+	original := testImage(40, 80)
+	crunched, err := compress(original, options{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := compareComposite(original, crunched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	composite, _, err := decodeImage(res.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := composite.Bounds().Size(), image.Pt(80, 80); got != want {
+		t.Errorf("composite is %v, want two 40×80 cells side by side", got)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const defaultLoadFraction = 0.6
+
+var (
+	placeholderGray = color.RGBA{R: 192, G: 192, B: 192, A: 255}
+	loadingBarFill  = color.RGBA{R: 0, G: 0, B: 128, A: 255}
+)
+
+// loadingEffect makes the image look like it's still coming in over a dial-up
+// line: only the top fraction has arrived, the rest is placeholder gray, and
+// a chunky progress bar says how far along it is. The argument is the
+// fraction loaded, from 0.05 to 0.95.
+func loadingEffect(img image.Image, args []string, rng *rand.Rand) (image.Image, error) {
+	def := config.Effects.Loading.Fraction
+	if def == 0 {
+		def = defaultLoadFraction
+	}
+	fraction, err := floatArg(args, 0, def, 0.05, 0.95)
+	if err != nil {
+		return nil, err
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(out, out.Bounds(), img, b.Min, draw.Src)
+
+	loaded := int(float64(h) * fraction)
+	draw.Draw(out, image.Rect(0, loaded, w, h), image.NewUniform(placeholderGray), image.Point{}, draw.Src)
+
+	// The bar sits in the middle of the gray part if there's room for it,
+	// otherwise at the bottom.
+	barW, barH := w*3/5, max(8, h/20)
+	x0 := (w - barW) / 2
+	y0 := loaded + (h-loaded-barH)/2
+	if h-loaded < barH*3 {
+		y0 = h - barH*2
+	}
+	bar := image.Rect(x0, y0, x0+barW, y0+barH)
+
+	draw.Draw(out, bar, image.White, image.Point{}, draw.Src)
+	border := max(1, barH/8)
+	for _, edge := range []image.Rectangle{
+		{bar.Min, image.Pt(bar.Max.X, bar.Min.Y+border)},
+		{image.Pt(bar.Min.X, bar.Max.Y-border), bar.Max},
+		{bar.Min, image.Pt(bar.Min.X+border, bar.Max.Y)},
+		{image.Pt(bar.Max.X-border, bar.Min.Y), bar.Max},
+	} {
+		draw.Draw(out, edge, image.Black, image.Point{}, draw.Src)
+	}
+
+	// Filled in with separate blocks, like progress bars used to be.
+	inner := bar.Inset(border * 2)
+	block, gap := max(2, inner.Dy()*2/3), max(1, inner.Dy()/4)
+	filled := inner.Min.X + int(float64(inner.Dx())*fraction)
+	for x := inner.Min.X; x+block <= filled; x += block + gap {
+		draw.Draw(out, image.Rect(x, inner.Min.Y, x+block, inner.Max.Y), image.NewUniform(loadingBarFill), image.Point{}, draw.Src)
+	}
+
+	if err := drawLoadingLabel(out, fmt.Sprintf("Loading... %d%%", int(fraction*100)), bar); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// drawLoadingLabel writes label just above the progress bar.
+func drawLoadingLabel(dst *image.RGBA, label string, bar image.Rectangle) error {
+	f, err := captionFont()
+	if err != nil {
+		return fmt.Errorf("error loading caption font: %w", err)
+	}
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: max(float64(bar.Dy()), minCaptionSize), DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return fmt.Errorf("error sizing caption font: %w", err)
+	}
+	defer face.Close()
+
+	x := fixed.I(bar.Min.X+bar.Dx()/2) - font.MeasureString(face, label)/2
+	y := bar.Min.Y - face.Metrics().Descent.Ceil() - bar.Dy()/4
+	drawOutlined(dst, face, label, x, y, max(1, bar.Dy()/16))
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func TestLoadingGolden(t *testing.T) {
+	img := testImage(96, 96)
+	out, err := loadingEffect(img, []string{"0.5"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "loading", out)
+
+	// The top half has arrived untouched, and the rest away from the bar
+	// is placeholder gray.
+	rgba := out.(*image.RGBA)
+	top := image.Rect(0, 0, 96, 40)
+	if d := meanDifference(rgba.SubImage(top), img.SubImage(top)); d != 0 {
+		t.Errorf("loaded part is %.2f off the original", d)
+	}
+	for _, p := range []image.Point{{2, 50}, {93, 94}, {2, 94}} {
+		if got := rgba.RGBAAt(p.X, p.Y); got != placeholderGray {
+			t.Errorf("unloaded part at %v is %v, want placeholder gray", p, got)
+		}
+	}
+
+	if _, err := loadingEffect(img, []string{"1"}, nil); err == nil {
+		t.Error("fully loaded was accepted")
+	}
+}
@@ -3,204 +3,766 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
 	"image/jpeg"
 	"image/png"
 	"io"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/mattn/go-mastodon"
-	"golang.org/x/image/webp"
 )
 
 type Config struct {
 	Server struct {
-		MastodonServer string `toml:"mastodon_server"`
-		ClientSecret   string `toml:"client_secret"`
-		AccessToken    string `toml:"access_token"`
+		MastodonServer    string  `toml:"mastodon_server"`
+		ClientSecret      string  `toml:"client_secret"`
+		AccessToken       string  `toml:"access_token"`
+		Warmup            bool    `toml:"warmup"`
+		MediaHost         string  `toml:"media_host"`
+		RateLimitHeadroom float64 `toml:"rate_limit_headroom"`
 	} `toml:"server"`
+	Bot struct {
+		FollowBack       bool          `toml:"follow_back"`
+		WelcomeMessage   string        `toml:"welcome_message"`
+		MirrorAccount    string        `toml:"mirror_account"`
+		MaxContentLength int           `toml:"max_content_length"`
+		PollDuration     time.Duration `toml:"poll_duration"`
+		PreferencesPath  string        `toml:"preferences_path"`
+		ProcessedPath    string        `toml:"processed_path"`
+		CatchUpCount     int           `toml:"catch_up_count"`
+		CatchUpMaxAge    time.Duration `toml:"catch_up_max_age"`
+		ThreadCooldown   time.Duration `toml:"thread_cooldown"`
+		StallTimeout     time.Duration `toml:"stall_timeout"`
+		EditDebounce     time.Duration `toml:"edit_debounce"`
+		Workers          int           `toml:"workers"`
+		MaxWorkers       int           `toml:"max_workers"`
+	} `toml:"bot"`
+	Reply struct {
+		MaxLength         int           `toml:"max_length"`
+		TruncateStrategy  string        `toml:"truncate_strategy"`
+		Footer            string        `toml:"footer"`
+		CCMentions        bool          `toml:"cc_mentions"`
+		ShowTiming        bool          `toml:"show_timing"`
+		OnDeletedParent   string        `toml:"on_deleted_parent"`
+		MaxReplies        int           `toml:"max_replies"`
+		StillWorkingAfter time.Duration `toml:"still_working_after"`
+		StillWorkingDM    bool          `toml:"still_working_dm"`
+		Sign              bool          `toml:"sign"`
+		IgnoreLanguage    bool          `toml:"ignore_language"`
+		Language          string        `toml:"language"`
+		IgnoreCW          bool          `toml:"ignore_cw"`
+		OnPartialUpload   string        `toml:"on_partial_upload"`
+	} `toml:"reply"`
+	Image struct {
+		Quality              int           `toml:"quality"`
+		FallbackFormat       string        `toml:"fallback_format"`
+		CropMode             string        `toml:"crop_mode"`
+		PipelineDepth        int           `toml:"pipeline_depth"`
+		Processing           string        `toml:"processing"`
+		ImageDelay           time.Duration `toml:"image_delay"`
+		BlockedHashes        []string      `toml:"blocked_hashes"`
+		Referer              string        `toml:"referer"`
+		ProgressionFormat    string        `toml:"progression_format"`
+		UniformThreshold     float64       `toml:"uniform_threshold"`
+		MaxFrameRate         float64       `toml:"max_frame_rate"`
+		MaxAnimationPixels   int           `toml:"max_animation_pixels"`
+		FrameRateAction      string        `toml:"frame_rate_action"`
+		Metadata             string        `toml:"metadata"`
+		NSFWThreshold        float64       `toml:"nsfw_threshold"`
+		NSFWSpoiler          string        `toml:"nsfw_spoiler"`
+		AlreadyCrunched      string        `toml:"already_crunched"`
+		MaxAspectRatio       float64       `toml:"max_aspect_ratio"`
+		Panorama             string        `toml:"panorama"`
+		PanoramaMaxDimension int           `toml:"panorama_max_dimension"`
+		MinOutputBytes       int           `toml:"min_output_bytes"`
+		EfficientOutput      string        `toml:"efficient_output"`
+		DecoderOrder         []string      `toml:"decoder_order"`
+		UniformMinBytes      int           `toml:"uniform_min_bytes"`
+
+		// DomainFormats lists the output formats each restricted domain accepts.
+		DomainFormats map[string][]string `toml:"domain_formats"`
+	} `toml:"image"`
+	Effects struct {
+		OnInapplicable string `toml:"on_inapplicable"`
+
+		CRT struct {
+			ScanlineDarkness float64 `toml:"scanline_darkness"`
+			ScanlineSpacing  int     `toml:"scanline_spacing"`
+			Shift            int     `toml:"shift"`
+		} `toml:"crt"`
+		Aberrate struct {
+			Shift int `toml:"shift"`
+		} `toml:"aberrate"`
+		Wave struct {
+			Amplitude float64 `toml:"amplitude"`
+			Frequency float64 `toml:"frequency"`
+		} `toml:"wave"`
+		Edges struct {
+			Blend float64 `toml:"blend"`
+		} `toml:"edges"`
+		Kaleidoscope struct {
+			Segments int `toml:"segments"`
+		} `toml:"kaleidoscope"`
+		Loading struct {
+			Fraction float64 `toml:"fraction"`
+		} `toml:"loading"`
+		Noise struct {
+			Color bool `toml:"color"`
+		} `toml:"noise"`
+		Film struct {
+			Grain    float64 `toml:"grain"`
+			Vignette float64 `toml:"vignette"`
+		} `toml:"film"`
+		Palette struct {
+			Colors int `toml:"colors"`
+		} `toml:"palette"`
+	} `toml:"effects"`
+	Metrics struct {
+		Sink         string `toml:"sink"`
+		Listen       string `toml:"listen"`
+		StatsdAddr   string `toml:"statsd_addr"`
+		StatsdPrefix string `toml:"statsd_prefix"`
+	} `toml:"metrics"`
+	SafeMode struct {
+		Enabled      bool     `toml:"enabled"`
+		Effects      []string `toml:"effects"`
+		QualityFloor int      `toml:"quality_floor"`
+	} `toml:"safe_mode"`
 }
 
 var config Config
 var ctx context.Context
 
+// selfID is the bot's own account ID.
+var selfID mastodon.ID
+
+const (
+	defaultQuality          = 5
+	defaultMaxContentLength = 5000
+)
+
+// result is a processed image ready to be uploaded, along with anything the
+// reply should mention about how it was made.
+type result struct {
+	Data    []byte
+	Format  string
+	Note    string
+	Elapsed time.Duration // time spent decoding and encoding
+	// Sensitive marks images the NSFW classifier flagged.
+	Sensitive bool
+	// Description is the attachment's alt text, if it needs one.
+	Description string
+}
+
+func (r *result) addNote(note string) {
+	if note == "" {
+		return
+	}
+	if r.Note != "" {
+		r.Note += " "
+	}
+	r.Note += note
+}
+
 func main() {
 	if _, err := toml.DecodeFile("config.toml", &config); err != nil {
 		log.Fatalf("Error loading config.toml: %v", err)
 	}
 
 	ctx = context.Background()
+
+	if err := setupMetrics(); err != nil {
+		log.Fatalf("Error setting up metrics: %v", err)
+	}
+
 	client := mastodon.NewClient(&mastodon.Config{
 		Server:       config.Server.MastodonServer,
 		ClientSecret: config.Server.ClientSecret,
 		AccessToken:  config.Server.AccessToken,
 	})
+	client.Transport = newRateLimitTransport(client.Transport)
+
+	if config.Server.Warmup {
+		go warmup(config.Server.MastodonServer, config.Server.MediaHost)
+	}
 
-	ws := client.NewWSClient()
-	events, err := ws.StreamingWSUser(ctx)
+	self, err := client.GetAccountCurrentUser(ctx)
 	if err != nil {
-		log.Fatalf("Error connecting to streaming API: %v", err)
+		log.Fatalf("Error fetching bot account: %v", err)
+	}
+	selfID = self.ID
+
+	loadSupportedMimeTypes(client)
+
+	preferencesPath := config.Bot.PreferencesPath
+	if preferencesPath == "" {
+		preferencesPath = defaultPreferencesPath
+	}
+	prefs, err = loadPreferences(preferencesPath)
+	if err != nil {
+		log.Fatalf("Error loading preferences: %v", err)
+	}
+
+	if config.Bot.ProcessedPath != "" {
+		if err := processed.load(config.Bot.ProcessedPath); err != nil {
+			log.Fatalf("Error loading processed notifications: %v", err)
+		}
 	}
 
 	fmt.Println("jpeg-bot is live! Listening for events...")
 
-	for event := range events {
-		if notification, ok := event.(*mastodon.NotificationEvent); ok && notification.Notification.Type == "mention" {
-			handleMention(client, notification.Notification)
+	runStream(client)
+}
+
+// warmup opens connections to the instance and its media host ahead of the
+// first mention so it doesn't pay for DNS and TLS handshakes. The API client
+// and the image downloader share the default transport, so the idle
+// connections left behind are reused by both. Failures are only logged.
+func warmup(hosts ...string) {
+	for _, host := range hosts {
+		if host == "" {
+			continue
+		}
+
+		reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		req, err := http.NewRequestWithContext(reqCtx, http.MethodHead, host, nil)
+		if err == nil {
+			var resp *http.Response
+			resp, err = http.DefaultClient.Do(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+		}
+		cancel()
+
+		if err != nil {
+			log.Printf("Warmup of %s failed: %v", host, err)
 		}
 	}
 }
 
 func handleMention(client *mastodon.Client, notification *mastodon.Notification) {
+	if err := validateMention(notification); err != nil {
+		log.Printf("Ignoring mention notification %s: %v", notification.ID, err)
+		return
+	}
 	status := notification.Status
-	images := collectImages(client, status)
+	log.Printf("Handling mention %s from %s (job %s)", status.ID, notification.Account.Acct, jobTag(notification))
+
+	maxLength := config.Bot.MaxContentLength
+	if maxLength <= 0 {
+		maxLength = defaultMaxContentLength
+	}
+	if len(status.Content) > maxLength {
+		log.Printf("Ignoring mention %s from %s: content is %d bytes, over the %d limit",
+			status.ID, notification.Account.Acct, len(status.Content), maxLength)
+		return
+	}
+
+	opts, err := parseMentionOptions(status.Content, status.SpoilerText)
+	if err != nil {
+		replyWithError(client, notification, err.Error())
+		return
+	}
+	opts.Seed = seedFor(status.ID)
+
+	conversationID := conversationRoot(client, status)
+	if !opts.Explicit && conversations.recentlyReplied(conversationID, config.Bot.ThreadCooldown) {
+		log.Printf("Ignoring mention %s from %s: already replied in conversation %s",
+			status.ID, notification.Account.Acct, conversationID)
+		return
+	}
+
+	if opts.Reset || opts.Save != nil {
+		updatePreferences(client, notification, opts)
+		return
+	}
+	applyPreferences(&opts, notification.Account.Acct)
+
+	var images []string
+	source := status
+	if opts.Avatar {
+		avatar, err := resolveAvatar(client, notification)
+		if err != nil {
+			replyWithError(client, notification, err.Error())
+			return
+		}
+		images = []string{avatar}
+	} else {
+		images, source = resolveImages(client, status)
+	}
 
 	if len(images) == 0 {
 		replyWithError(client, notification, "No images found to process.")
 		return
 	}
 
-	for _, imageURL := range images {
-		compressedJPEG, err := downloadAndCompressImage(imageURL)
-		if err != nil {
-			replyWithError(client, notification, fmt.Sprintf("Error compressing image: %v", err))
-			continue
+	maxReplies := config.Reply.MaxReplies
+	if maxReplies <= 0 {
+		maxReplies = defaultMaxReplies
+	}
+
+	spoiler, sensitive := matchingCW(status, source)
+	stopInterim := startInterimMessage(client, notification)
+	defer stopInterim()
+
+	polled := false
+	c := newCollector(maxReplies*mediaPerReply, spoiler, sensitive, func(b batch) {
+		stopInterim()
+		var posted *mastodon.Status
+		if opts.DataURI {
+			posted = replyWithDataURIs(client, b, notification, status.Visibility)
+		} else {
+			posted = uploadMediaAndReply(client, b, notification, status.Visibility)
+		}
+		if posted != nil {
+			conversations.record(conversationID)
 		}
-		uploadMediaAndReply(client, compressedJPEG, notification, status.Visibility)
+		if posted != nil && opts.Poll && !polled {
+			postPoll(client, notification, posted)
+			polled = true
+		}
+	})
+	if limit := maxReplies * mediaPerReply; len(images) > limit {
+		c.note(fmt.Sprintf("I only do %d images per mention, so I skipped the other %d.", limit, len(images)-limit))
+		images = images[:limit]
 	}
-}
 
-func collectImages(client *mastodon.Client, status *mastodon.Status) []string {
-	var images []string
+	collect := func(res result, err error) {
+		if errors.Is(err, errBlockedImage) {
+			log.Printf("Refusing blocklisted image for %s", notification.Account.Acct)
+		}
+		c.add(res, err)
+	}
+	processAll(images, opts, collect)
+	c.flush()
+}
 
-	// Collect images from the current post
-	for _, attachment := range status.MediaAttachments {
-		if attachment.Type == "image" {
-			images = append(images, attachment.URL)
+// processAll runs a mention's images through the pipeline, or strictly one
+// at a time with image_delay in between in sequential mode, to keep the load
+// on small hosts flat.
+func processAll(images []string, opts options, done func(result, error)) {
+	if config.Image.Processing != "sequential" {
+		processImages(images, opts, done)
+		return
+	}
+	for i, imageURL := range images {
+		if i > 0 {
+			time.Sleep(config.Image.ImageDelay)
 		}
+		processImages([]string{imageURL}, opts, done)
+	}
+}
+
+// failureMessage explains to the requester why an image couldn't be
+// crunched.
+func failureMessage(err error) string {
+	switch {
+	case errors.Is(err, errBlockedImage):
+		return "Sorry, I can't process that image."
+	case errors.Is(err, errAlreadyCrunched):
+		return "That JPEG is already as crunched as you asked for, try a lower quality."
+	case errors.Is(err, errNotAnImage):
+		return "That link isn't a direct image."
 	}
+	return fmt.Sprintf("Error compressing image: %v", err)
+}
+
+var postableVisibilities = map[string]bool{
+	mastodon.VisibilityPublic:        true,
+	mastodon.VisibilityUnlisted:      true,
+	mastodon.VisibilityFollowersOnly: true,
+	mastodon.VisibilityDirectMessage: true,
+}
+
+// validateMention checks a mention is about a real, posted status that can
+// be replied to. Notifications occasionally arrive for statuses in odd
+// states, and those are better skipped than half-handled.
+func validateMention(notification *mastodon.Notification) error {
+	status := notification.Status
+	switch {
+	case status == nil:
+		return fmt.Errorf("no status")
+	case status.ID == "":
+		return fmt.Errorf("status has no ID")
+	case status.URI == "" && status.URL == "":
+		return fmt.Errorf("status %s has no URL", status.ID)
+	case notification.Account.Acct == "":
+		return fmt.Errorf("status %s has no author", status.ID)
+	case !postableVisibilities[status.Visibility]:
+		return fmt.Errorf("status %s has visibility %q", status.ID, status.Visibility)
+	}
+	return nil
+}
 
-	// If no images found, check if it's replying to another post
-	if len(images) == 0 && status.InReplyToID != "" {
-		originalStatusIDa := status.InReplyToID
-		if originalStatusIDa == nil {
-			return images
+// updatePreferences handles "set" and "reset" mentions.
+func updatePreferences(client *mastodon.Client, notification *mastodon.Notification, opts options) {
+	acct := notification.Account.Acct
+
+	if opts.Reset {
+		if err := prefs.reset(acct); err != nil {
+			log.Printf("Error resetting preferences for %s: %v", acct, err)
+			replyWithError(client, notification, "I couldn't forget your settings, please try again later.")
+			return
 		}
+		replyWithMessage(client, notification, "Done, I've forgotten your settings.")
+		return
+	}
 
-		var originalStatusID mastodon.ID
+	if err := prefs.update(acct, *opts.Save); err != nil {
+		log.Printf("Error saving preferences for %s: %v", acct, err)
+		replyWithError(client, notification, "I couldn't save your settings, please try again later.")
+		return
+	}
 
-		switch id := originalStatusIDa.(type) {
-		case string:
-			originalStatusID = mastodon.ID(id)
-		case mastodon.ID:
-			originalStatusID = id
-		default:
-			log.Printf("Unexpected type for InReplyToID: %T", originalStatusIDa)
+	saved := prefs.get(acct)
+	var settings []string
+	if saved.Quality != 0 {
+		settings = append(settings, fmt.Sprintf("quality %d", saved.Quality))
+	}
+	if saved.Format != "" {
+		settings = append(settings, "format "+saved.Format)
+	}
+	replyWithMessage(client, notification, fmt.Sprintf("Saved! Your defaults are now %s.", strings.Join(settings, ", ")))
+}
+
+// handleFollow optionally follows new followers back and sends them a DM
+// explaining how to use the bot.
+func handleFollow(client *mastodon.Client, notification *mastodon.Notification) {
+	account := notification.Account
+
+	if config.Bot.FollowBack {
+		if _, err := client.AccountFollow(ctx, account.ID); err != nil {
+			log.Printf("Error following back %s: %v", account.Acct, err)
 		}
+	}
 
-		originalStatus, err := client.GetStatus(ctx, originalStatusID)
-		if err == nil {
-			for _, attachment := range originalStatus.MediaAttachments {
-				if attachment.Type == "image" {
-					images = append(images, attachment.URL)
-				}
-			}
+	if config.Bot.WelcomeMessage != "" {
+		welcome := &mastodon.Toot{
+			Status:     fmt.Sprintf("@%s %s", account.Acct, config.Bot.WelcomeMessage),
+			Visibility: mastodon.VisibilityDirectMessage,
+		}
+		if _, err := postStatus(client, welcome); err != nil {
+			log.Printf("Error sending welcome message to %s: %v", account.Acct, err)
 		}
 	}
+}
 
-	return images
+// downloadImage fetches an image, sending the configured Referer if there is
+// one. Some CDNs refuse hotlinked downloads with a 403, so those are retried
+// once with the instance's URL as the Referer.
+func downloadImage(imageURL string) ([]byte, error) {
+	imgData, status, err := fetchImage(imageURL, config.Image.Referer)
+	if status == http.StatusForbidden && config.Image.Referer == "" {
+		log.Printf("Download of %s was forbidden, retrying with a Referer", imageURL)
+		imgData, _, err = fetchImage(imageURL, config.Server.MastodonServer)
+	}
+	return imgData, err
 }
 
-func downloadAndCompressImage(imageURL string) ([]byte, error) {
-	resp, err := http.Get(imageURL)
+func fetchImage(imageURL, referer string) ([]byte, int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to download image: %w", err)
+		return nil, 0, fmt.Errorf("failed to download image: %w", err)
+	}
+	if referer != "" {
+		req.Header.Set("Referer", referer)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to download image: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, resp.StatusCode, fmt.Errorf("failed to download image: %s", resp.Status)
+	}
+
 	imgData, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read image data: %w", err)
+		return nil, resp.StatusCode, fmt.Errorf("failed to read image data: %w", err)
 	}
 
-	img, format, err := decodeImage(imgData)
-	if err != nil {
-		return nil, fmt.Errorf("error decoding image: %w", err)
+	// Links to a page showing the image, rather than to the image itself.
+	contentType := resp.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "text/html") || strings.HasPrefix(http.DetectContentType(imgData), "text/html") {
+		log.Printf("Download of %s is an HTML page (%s)", imageURL, contentType)
+		return nil, resp.StatusCode, errNotAnImage
 	}
+	return imgData, resp.StatusCode, nil
+}
 
-	log.Printf("Decoded image with format: %s", format)
+var errNotAnImage = errors.New("that link isn't a direct image")
 
-	var buf bytes.Buffer
-	err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 5})
+// decodeInput decodes imgData into either a still image or, for animated
+// GIFs, an animation. Asking for a specific frame turns an animation into
+// that one still.
+func decodeInput(imgData []byte, opts options) (image.Image, *animation, string, error) {
+	if !isGIF(imgData) {
+		if opts.Frame > 0 {
+			return nil, nil, "", fmt.Errorf("frame only works on animated GIFs")
+		}
+		img, format, err := decodeImage(imgData)
+		return img, nil, format, err
+	}
+
+	anim, err := decodeAnimation(imgData)
 	if err != nil {
-		return nil, fmt.Errorf("error encoding to jpeg: %w", err)
+		return nil, nil, "", err
+	}
+	if opts.Frame > len(anim.Frames) {
+		return nil, nil, "", fmt.Errorf("that GIF only has %d frames", len(anim.Frames))
 	}
 
-	return buf.Bytes(), nil
+	switch {
+	case opts.Frame > 0:
+		return anim.Frames[opts.Frame-1], nil, "gif", nil
+	case len(anim.Frames) == 1:
+		return anim.Frames[0], nil, "gif", nil
+	}
+	return nil, anim, "gif", nil
+}
+
+// prepareImage applies the requested crop, effects and caption ahead of
+// crunching.
+func prepareImage(img image.Image, opts options) (image.Image, error) {
+	var err error
+	if opts.Crop != nil {
+		img, err = cropImage(img, *opts.Crop)
+		if err != nil {
+			return nil, err
+		}
+	}
+	img, err = applyEffects(img, opts.Effects, opts.Seed)
+	if err != nil || (opts.CaptionTop == "" && opts.CaptionBottom == "") {
+		return img, err
+	}
+	return drawCaption(img, opts.CaptionTop, opts.CaptionBottom)
 }
 
-func decodeImage(imgData []byte) (image.Image, string, error) {
-	reader := bytes.NewReader(imgData)
+func processStill(original image.Image, opts options, originalLength int) (result, error) {
+	img, err := prepareImage(original, opts)
+	if err != nil {
+		return result{}, err
+	}
 
-	if strings.HasPrefix(fmt.Sprintf("%x", imgData[:8]), "89504e470d0a1a0a") {
-		img, err := png.Decode(reader)
-		if err == nil {
-			return img, "png", nil
+	res, err := compress(img, opts, originalLength)
+	if err != nil {
+		return result{}, err
+	}
+
+	if opts.Crop != nil && config.Image.CropMode == "inplace" {
+		res, err = pasteCrunched(original, *opts.Crop, res)
+		if err != nil {
+			return result{}, err
 		}
-		return nil, "", fmt.Errorf("PNG decoding failed: %w", err)
+	}
+	if opts.Compare {
+		return compareComposite(original, res)
+	}
+	return res, nil
+}
+
+func compress(img image.Image, opts options, originalLength int) (result, error) {
+	if budget := opts.budget(originalLength); budget > 0 {
+		return compressToBudget(img, budget)
 	}
 
-	img, format, err := image.Decode(reader)
+	palette := sourcePalette(img)
+	img = efficientImage(img)
+
+	res, err := encodeImage(img, opts.quality(), opts.encoder())
 	if err == nil {
-		return img, format, nil
+		res, err = meetMinimumSize(img, res, opts.quality(), opts.encoder())
+	}
+	if err != nil || opts.Format != "png" || res.Format != "jpeg" {
+		return res, err
+	}
+	return convertToPNG(res, palette)
+}
+
+// convertToPNG re-encodes a crunched JPEG losslessly as a PNG, keeping every
+// artifact. Given a palette, the PNG is paletted, which is much smaller for
+// sources that only had that many colours to begin with.
+func convertToPNG(res result, palette color.Palette) (result, error) {
+	img, _, err := decodeImage(res.Data)
+	if err != nil {
+		return result{}, fmt.Errorf("error decoding crunched image: %w", err)
+	}
+	if palette != nil {
+		b := img.Bounds()
+		paletted := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), palette)
+		draw.Draw(paletted, paletted.Bounds(), img, b.Min, draw.Src)
+		img = paletted
 	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return result{}, fmt.Errorf("error encoding png: %w", err)
+	}
+	res.Data, res.Format = buf.Bytes(), "png"
+	return res, nil
+}
 
-	reader.Seek(0, io.SeekStart)
-	img, err = webp.Decode(reader)
+// encodeImage encodes img as a JPEG, falling back to the configured fallback
+// format when the JPEG encoder rejects the image.
+func encodeImage(img image.Image, quality int, encode jpegEncoder) (result, error) {
+	data, err := encode(img, quality)
 	if err == nil {
-		return img, "webp", nil
+		return result{Data: data, Format: "jpeg"}, nil
 	}
 
-	return nil, "", fmt.Errorf("unsupported image format")
+	fallback := config.Image.FallbackFormat
+	if fallback == "" {
+		fallback = "png"
+	}
+	if fallback != "png" {
+		return result{}, err
+	}
+
+	log.Printf("JPEG encoding failed (%v), falling back to %s", err, fallback)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return result{}, fmt.Errorf("error encoding fallback png: %w", err)
+	}
+	return result{
+		Data:   buf.Bytes(),
+		Format: "png",
+		Note:   "The JPEG encoder choked on this one, so it's a PNG instead.",
+	}, nil
 }
 
-func uploadMediaAndReply(client *mastodon.Client, compressedJPEG []byte, notification *mastodon.Notification, visibility string) {
-	media, err := client.UploadMediaFromReader(ctx, bytes.NewReader(compressedJPEG))
+// jpegEncoder encodes img as a JPEG at the given quality.
+type jpegEncoder func(img image.Image, quality int) ([]byte, error)
+
+func encodeJPEG(img image.Image, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
 	if err != nil {
-		replyWithError(client, notification, fmt.Sprintf("Error uploading media: %v", err))
-		return
+		return nil, fmt.Errorf("error encoding to jpeg: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// compressToBudget searches for the highest quality whose output still fits
+// in budget bytes. If even the lowest quality is too big, the smallest
+// possible output is returned with a note saying so.
+func compressToBudget(img image.Image, budget int64) (result, error) {
+	lowest := max(1, safeModeQualityFloor())
+	smallest, err := encodeJPEG(img, lowest)
+	if err != nil {
+		return encodeImage(img, lowest, encodeJPEG)
+	}
+	if int64(len(smallest)) > budget {
+		note := fmt.Sprintf("Couldn't get it under %s even at maximum compression, this is as small as it goes (%s).",
+			formatBytes(budget), formatBytes(int64(len(smallest))))
+		return result{Data: smallest, Format: "jpeg", Note: note}, nil
 	}
 
-	if visibility == "public" {
-		visibility = "unlisted"
+	best := smallest
+	low, high := lowest+1, 100
+	for low <= high {
+		quality := (low + high) / 2
+		data, err := encodeJPEG(img, quality)
+		if err != nil {
+			return result{}, err
+		}
+		if int64(len(data)) <= budget {
+			best = data
+			low = quality + 1
+		} else {
+			high = quality - 1
+		}
 	}
 
-	reply := &mastodon.Toot{
-		Status:      fmt.Sprintf("@%s Here's your compressed JPEG!", notification.Account.Acct),
-		InReplyToID: notification.Status.ID,
-		MediaIDs:    []mastodon.ID{media.ID},
-		Visibility:  visibility,
+	return result{Data: best, Format: "jpeg"}, nil
+}
+
+// meetMinimumSize re-encodes a JPEG that came out smaller than
+// min_output_bytes at the lowest quality above quality that's big enough,
+// since some instances flag or refuse uploads that tiny. If even quality 100
+// is too small, that's what's returned.
+func meetMinimumSize(img image.Image, res result, quality int, encode jpegEncoder) (result, error) {
+	minimum := int64(config.Image.MinOutputBytes)
+	if minimum <= 0 || res.Format != "jpeg" || int64(len(res.Data)) >= minimum {
+		return res, nil
 	}
 
-	_, err = client.PostStatus(ctx, reply)
-	if err != nil {
-		replyWithError(client, notification, fmt.Sprintf("Error posting reply: %v", err))
+	best, bestQuality := res.Data, quality
+	low, high := quality+1, 100
+	for low <= high {
+		q := (low + high) / 2
+		data, err := encode(img, q)
+		if err != nil {
+			return result{}, err
+		}
+		if int64(len(data)) >= minimum || q == 100 {
+			best, bestQuality = data, q
+			high = q - 1
+		} else {
+			low = q + 1
+		}
+	}
+	if bestQuality == quality {
+		return res, nil
 	}
+
+	log.Printf("Output was under %s at quality %d, bumped to %d", formatBytes(minimum), quality, bestQuality)
+	res.Data = best
+	res.addNote(fmt.Sprintf("That came out suspiciously tiny, so I nudged the quality up to %d.", bestQuality))
+	return res, nil
 }
 
-func replyWithError(client *mastodon.Client, notification *mastodon.Notification, errorMsg string) {
-	reply := &mastodon.Toot{
-		Status:      fmt.Sprintf("@%s Oops! %s", notification.Account.Acct, errorMsg),
-		InReplyToID: notification.Status.ID,
-		Visibility:  notification.Status.Visibility,
+// decodeImage decodes a still image, trying the decoders in decoder_order
+// until one works. Some decoders (notably x/image/webp) can panic on
+// malformed input, so panics are turned into errors rather than taking the
+// whole bot down.
+func decodeImage(imgData []byte) (img image.Image, format string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Recovered from panic while decoding image: %v", r)
+			img, format, err = nil, "", fmt.Errorf("the image is malformed")
+		}
+	}()
+
+	isPNG := len(imgData) >= 8 && strings.HasPrefix(fmt.Sprintf("%x", imgData[:8]), "89504e470d0a1a0a")
+	if isPNG && isAPNG(imgData) {
+		return nil, "", fmt.Errorf("animated PNGs (APNG) aren't supported yet")
 	}
 
-	_, err := client.PostStatus(ctx, reply)
-	if err != nil {
-		log.Printf("Error posting error reply: %v", err)
+	img, format, err = decodeWithFallbacks(imgData)
+	switch {
+	case err == nil:
+		return img, format, nil
+	case isPNG:
+		return nil, "", fmt.Errorf("PNG decoding failed: %w", err)
+	}
+	return nil, "", fmt.Errorf("unsupported image format")
+}
+
+// isAPNG reports whether PNG data is animated, which is signalled by an acTL
+// chunk appearing before the first IDAT chunk.
+func isAPNG(pngData []byte) bool {
+	pos := 8
+	for pos+8 <= len(pngData) {
+		length := int(binary.BigEndian.Uint32(pngData[pos:]))
+		switch string(pngData[pos+4 : pos+8]) {
+		case "acTL":
+			return true
+		case "IDAT":
+			return false
+		}
+		pos += 12 + length
 	}
+	return false
 }
@@ -0,0 +1,758 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+func TestMain(m *testing.M) {
+	ctx = context.Background()
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+
+	dir, err := os.MkdirTemp("", "jpeg-bot-test-")
+	if err != nil {
+		panic(err)
+	}
+	prefs = &preferenceStore{path: filepath.Join(dir, "preferences.json"), prefs: make(map[string]preferences)}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// withConfig lets a test change the config, putting it back afterwards.
+// Slices and maps are shared with the saved copy, so tests replace them
+// rather than modifying them in place.
+func withConfig(t *testing.T, change func(c *Config)) {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() {
+		settle()
+		config = saved
+	})
+	change(&config)
+}
+
+// settle waits for the jobs already queued on the pools to finish, so none
+// is still reading the config when it's changed for the next test.
+func settle() {
+	pools.mu.Lock()
+	all := make([]*accountPool, 0, len(pools.pools))
+	for _, p := range pools.pools {
+		all = append(all, p)
+	}
+	pools.mu.Unlock()
+
+	// Once every worker is holding one of these, nothing else is running.
+	workers := max(config.Bot.Workers, defaultWorkers)
+	for _, p := range all {
+		var arrived sync.WaitGroup
+		arrived.Add(workers)
+		release := make(chan struct{})
+		for i := 0; i < workers; i++ {
+			p.submit(func() {
+				arrived.Done()
+				<-release
+			})
+		}
+		arrived.Wait()
+		close(release)
+	}
+}
+
+// testImage is a deterministic image with gradients, hard edges and some
+// noise, so that it compresses like a photo rather than a flat graphic.
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	rng := rand.New(rand.NewSource(1))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{
+				R: uint8(x * 255 / max(w-1, 1)),
+				G: uint8(y * 255 / max(h-1, 1)),
+				B: uint8((x + y) * 4),
+				A: 255,
+			}
+			if (x/8+y/8)%2 == 0 {
+				c.B = 255 - c.B
+			}
+			n := uint8(rng.Intn(32))
+			c.R, c.G = c.R^n, c.G^n
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden images in testdata")
+
+// goldenTolerance is how far an image may drift from its golden copy, as
+// the mean difference per channel out of 255. It leaves room for small
+// floating point differences between platforms, not for visible changes.
+const goldenTolerance = 2.0
+
+// checkGolden compares img with testdata/name.png. Run the tests with
+// -update to write the golden images after a deliberate change.
+func checkGolden(t *testing.T, name string, img image.Image) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".png")
+	if *updateGolden {
+		if err := os.MkdirAll("testdata", 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, encodePNG(t, img), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	golden, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := img.Bounds().Size(), golden.Bounds().Size(); got != want {
+		t.Fatalf("%s is %v, golden image is %v", name, got, want)
+	}
+	if diff := meanDifference(img, golden); diff > goldenTolerance {
+		t.Errorf("%s differs from its golden image by %.2f per channel, over %.2f", name, diff, goldenTolerance)
+	}
+}
+
+// meanDifference is the mean absolute difference per colour channel between
+// two same-sized images, out of 255.
+func meanDifference(a, b image.Image) float64 {
+	ab, bb := a.Bounds(), b.Bounds()
+	var total float64
+	for y := 0; y < ab.Dy(); y++ {
+		for x := 0; x < ab.Dx(); x++ {
+			r1, g1, b1, _ := a.At(ab.Min.X+x, ab.Min.Y+y).RGBA()
+			r2, g2, b2, _ := b.At(bb.Min.X+x, bb.Min.Y+y).RGBA()
+			for _, d := range []int{int(r1) - int(r2), int(g1) - int(g2), int(b1) - int(b2)} {
+				total += float64(max(d, -d)) / 257
+			}
+		}
+	}
+	return total / float64(3*ab.Dx()*ab.Dy())
+}
+
+// crunch runs img through the still image path as a mention with content
+// would, and decodes what comes out.
+func crunch(t *testing.T, img image.Image, content string) image.Image {
+	t.Helper()
+	opts, err := parseOptions(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := processStill(img, opts, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _, err := decodeImage(res.Data)
+	if err != nil {
+		t.Fatalf("output doesn't decode: %v", err)
+	}
+	return out
+}
+
+func sameColor(a, b color.Color) bool {
+	r1, g1, b1, a1 := a.RGBA()
+	r2, g2, b2, a2 := b.RGBA()
+	return r1 == r2 && g1 == g2 && b1 == b2 && a1 == a2
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeJPEGData(t *testing.T, img image.Image, quality int) []byte {
+	t.Helper()
+	data, err := encodeJPEG(img, quality)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCompressToBudgetConverges(t *testing.T) {
+	img := testImage(96, 96)
+
+	// Sizes only mostly go up with quality, so the search is only expected
+	// to find the best quality on a stretch where they do.
+	sizes := make([]int, 101)
+	for q := 1; q <= 100; q++ {
+		data, err := encodeJPEG(img, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[q] = len(data)
+	}
+	budget := int64(sizes[40]+sizes[41]) / 2
+
+	res, err := compressToBudget(img, budget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(res.Data)) > budget {
+		t.Fatalf("output is %d bytes, over the %d budget", len(res.Data), budget)
+	}
+	if res.Note != "" {
+		t.Errorf("unexpected note %q", res.Note)
+	}
+	// Nothing much bigger would still have fit.
+	if int64(len(res.Data)) < budget*9/10 {
+		t.Errorf("output is %d bytes, well under the %d budget", len(res.Data), budget)
+	}
+}
+
+func TestCompressToBudgetUnreachable(t *testing.T) {
+	img := testImage(96, 96)
+	smallest, err := encodeJPEG(img, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := compressToBudget(img, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Data) != len(smallest) {
+		t.Errorf("got %d bytes, want the quality 1 output of %d", len(res.Data), len(smallest))
+	}
+	if !strings.Contains(res.Note, "Couldn't get it under 100 B") {
+		t.Errorf("note %q doesn't explain the target was missed", res.Note)
+	}
+}
+
+func TestPercentSizeTarget(t *testing.T) {
+	opts, err := parseOptions("@bot size 25%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := opts.budget(10000); got != 2500 {
+		t.Errorf("budget of 25%% of 10000 = %d, want 2500", got)
+	}
+
+	for _, bad := range []string{"size 0%", "size 150%", "size lots%"} {
+		if _, err := parseOptions(bad); err == nil {
+			t.Errorf("%q parsed without an error", bad)
+		}
+	}
+}
+
+func TestEncodeImageFallsBackToPNG(t *testing.T) {
+	rejecting := func(image.Image, int) ([]byte, error) {
+		return nil, errors.New("unsupported")
+	}
+	img := testImage(16, 16)
+
+	withConfig(t, func(c *Config) { c.Image.FallbackFormat = "" })
+	res, err := encodeImage(img, 5, rejecting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Format != "png" || res.Note == "" {
+		t.Errorf("got format %q with note %q, want a png with a note", res.Format, res.Note)
+	}
+	decoded, err := png.Decode(bytes.NewReader(res.Data))
+	if err != nil {
+		t.Fatalf("fallback isn't a valid PNG: %v", err)
+	}
+	if decoded.Bounds() != img.Bounds() {
+		t.Errorf("fallback is %v, want %v", decoded.Bounds(), img.Bounds())
+	}
+
+	withConfig(t, func(c *Config) { c.Image.FallbackFormat = "none" })
+	if _, err := encodeImage(img, 5, rejecting); err == nil {
+		t.Error("fallback_format none didn't return the encoder's error")
+	}
+}
+
+// fakeInstance is just enough of a Mastodon API for the bot to talk to. It
+// records what gets posted and uploaded, and tests can take over any route
+// with handle.
+type fakeInstance struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	routes   map[string]http.HandlerFunc // keyed by "METHOD /path"
+	statuses map[mastodon.ID]*mastodon.Status
+	posts    []url.Values
+	uploads  []*http.Request
+	media    [][]byte
+}
+
+func newFakeInstance(t *testing.T) (*fakeInstance, *mastodon.Client) {
+	t.Helper()
+	f := &fakeInstance{
+		routes:   make(map[string]http.HandlerFunc),
+		statuses: make(map[mastodon.ID]*mastodon.Status),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.server.Close)
+
+	// Every test gets pools and caches of its own, so jobs and IDs from one
+	// don't leak into the next.
+	savedPools, savedProcessed := pools, processed
+	t.Cleanup(func() {
+		settle()
+		pools, processed = savedPools, savedProcessed
+	})
+	pools = &poolRegistry{pools: make(map[*mastodon.Client]*accountPool)}
+	processed = newProcessedCache(processedCacheSize)
+
+	client := mastodon.NewClient(&mastodon.Config{Server: f.server.URL, AccessToken: "token"})
+	return f, client
+}
+
+func (f *fakeInstance) url(path string) string {
+	return f.server.URL + path
+}
+
+// handle takes over requests for method and path.
+func (f *fakeInstance) handle(method, path string, h http.HandlerFunc) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.routes[method+" "+path] = h
+}
+
+// serveFile serves data at path, as an image host would.
+func (f *fakeInstance) serveFile(path, contentType string, data []byte) string {
+	f.handle(http.MethodGet, path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write(data)
+	})
+	return f.url(path)
+}
+
+func (f *fakeInstance) addStatus(status *mastodon.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statuses[status.ID] = status
+}
+
+// posted returns the form of every status posted so far.
+func (f *fakeInstance) posted() []url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]url.Values(nil), f.posts...)
+}
+
+func (f *fakeInstance) uploaded() [][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]byte(nil), f.media...)
+}
+
+func (f *fakeInstance) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	route := f.routes[r.Method+" "+r.URL.Path]
+	f.mu.Unlock()
+	if route != nil {
+		route(w, r)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1/statuses":
+		r.ParseForm()
+		f.mu.Lock()
+		f.posts = append(f.posts, r.PostForm)
+		id := fmt.Sprint(1000 + len(f.posts))
+		f.mu.Unlock()
+		writeJSON(w, mastodon.Status{
+			ID:         mastodon.ID(id),
+			URL:        f.url("/@bot/" + id),
+			Visibility: r.PostForm.Get("visibility"),
+		})
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1/media":
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(file)
+		f.mu.Lock()
+		f.uploads = append(f.uploads, r)
+		f.media = append(f.media, data)
+		id := fmt.Sprint("media", len(f.media))
+		f.mu.Unlock()
+		writeJSON(w, mastodon.Attachment{ID: mastodon.ID(id), Type: "image"})
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/api/v1/statuses/"):
+		f.mu.Lock()
+		status := f.statuses[mastodon.ID(strings.TrimPrefix(r.URL.Path, "/api/v1/statuses/"))]
+		f.mu.Unlock()
+		if status == nil {
+			http.Error(w, `{"error":"Record not found"}`, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, status)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1/notifications":
+		writeJSON(w, []*mastodon.Notification{})
+	default:
+		http.Error(w, `{"error":"not faked"}`, http.StatusNotFound)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// waitFor polls until cond holds, failing the test if it doesn't within a
+// few seconds. Jobs run on worker goroutines, so tests wait on their
+// effects.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// mention builds a mention notification as the streaming API delivers it.
+func mention(id, acct, content string) *mastodon.Notification {
+	return &mastodon.Notification{
+		ID:      mastodon.ID("n" + id),
+		Type:    "mention",
+		Account: mastodon.Account{ID: "a-" + mastodon.ID(acct), Acct: acct},
+		Status: &mastodon.Status{
+			ID:         mastodon.ID(id),
+			URI:        "https://example.com/statuses/" + id,
+			URL:        "https://example.com/@" + acct + "/" + id,
+			Content:    content,
+			Visibility: mastodon.VisibilityPublic,
+			Account:    mastodon.Account{ID: "a-" + mastodon.ID(acct), Acct: acct},
+		},
+	}
+}
+
+func TestHandleFollow(t *testing.T) {
+	f, client := newFakeInstance(t)
+	withConfig(t, func(c *Config) {
+		c.Bot.FollowBack = true
+		c.Bot.WelcomeMessage = "Mention me on a post with an image!"
+	})
+
+	followed := false
+	f.handle(http.MethodPost, "/api/v1/accounts/42/follow", func(w http.ResponseWriter, r *http.Request) {
+		followed = true
+		writeJSON(w, mastodon.Relationship{ID: "42", Following: true})
+	})
+
+	handleFollow(client, &mastodon.Notification{
+		ID:      "n1",
+		Type:    "follow",
+		Account: mastodon.Account{ID: "42", Acct: "new@example.com"},
+	})
+
+	if !followed {
+		t.Error("new follower wasn't followed back")
+	}
+	posts := f.posted()
+	if len(posts) != 1 {
+		t.Fatalf("posted %d statuses, want a welcome DM", len(posts))
+	}
+	if got, want := posts[0].Get("status"), "@new@example.com Mention me on a post with an image!"; got != want {
+		t.Errorf("welcome message is %q, want %q", got, want)
+	}
+	if got := posts[0].Get("visibility"); got != mastodon.VisibilityDirectMessage {
+		t.Errorf("welcome message has visibility %q, want direct", got)
+	}
+}
+
+func TestHandleFollowDisabled(t *testing.T) {
+	f, client := newFakeInstance(t)
+	withConfig(t, func(c *Config) {
+		c.Bot.FollowBack = false
+		c.Bot.WelcomeMessage = ""
+	})
+
+	handleFollow(client, &mastodon.Notification{ID: "n1", Type: "follow", Account: mastodon.Account{ID: "42", Acct: "new"}})
+	if posts := f.posted(); len(posts) != 0 {
+		t.Errorf("posted %d statuses with welcome messages off", len(posts))
+	}
+}
+
+// makeAPNG turns a PNG into an animated one by adding an acTL chunk after
+// the header, which is all the detection looks at.
+func makeAPNG(t *testing.T, pngData []byte) []byte {
+	t.Helper()
+	const ihdrEnd = 8 + 4 + 4 + 13 + 4
+	chunk := []byte{0, 0, 0, 8, 'a', 'c', 'T', 'L', 0, 0, 0, 2, 0, 0, 0, 0}
+	chunk = append(chunk, 0, 0, 0, 0) // the CRC isn't checked
+	apng := append([]byte(nil), pngData[:ihdrEnd]...)
+	apng = append(apng, chunk...)
+	return append(apng, pngData[ihdrEnd:]...)
+}
+
+func TestDetectAPNG(t *testing.T) {
+	plain := encodePNG(t, testImage(8, 8))
+	if isAPNG(plain) {
+		t.Error("plain PNG detected as animated")
+	}
+	if _, format, err := decodeImage(plain); err != nil || format != "png" {
+		t.Errorf("plain PNG decoded as %q, %v", format, err)
+	}
+
+	apng := makeAPNG(t, plain)
+	if !isAPNG(apng) {
+		t.Fatal("APNG not detected")
+	}
+	if _, _, err := decodeImage(apng); err == nil || !strings.Contains(err.Error(), "APNG") {
+		t.Errorf("decoding an APNG gave %v, want an error saying APNGs aren't supported", err)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	var methods []string
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods = append(methods, r.Method)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	// A host that refuses connections is only logged, and doesn't stop the
+	// others from being warmed up.
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refused.Close()
+
+	done := make(chan struct{})
+	go func() {
+		warmup(refused.URL, "", server.URL)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("warmup blocked on an unreachable host")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(methods) != 1 || methods[0] != http.MethodHead {
+		t.Errorf("reachable host got %v, want a single HEAD", methods)
+	}
+}
+
+func TestOversizedMentionIgnored(t *testing.T) {
+	f, client := newFakeInstance(t)
+	withConfig(t, func(c *Config) { c.Bot.MaxContentLength = 100 })
+
+	handleMention(client, mention("1", "alice", "<p>@bot "+strings.Repeat("crunch ", 20)+"</p>"))
+	if posts := f.posted(); len(posts) != 0 {
+		t.Fatalf("replied to an oversized mention: %v", posts)
+	}
+
+	// One under the limit is handled as usual, here with a reply saying
+	// there's nothing to crunch.
+	handleMention(client, mention("2", "alice", "<p>@bot crunch</p>"))
+	posts := f.posted()
+	if len(posts) != 1 || !strings.Contains(posts[0].Get("status"), "No images found") {
+		t.Errorf("mention under the limit got %v", posts)
+	}
+}
+
+func TestDownloadRetriesWithReferer(t *testing.T) {
+	f, _ := newFakeInstance(t)
+	withConfig(t, func(c *Config) {
+		c.Server.MastodonServer = "https://instance.example.com"
+		c.Image.Referer = ""
+	})
+
+	var referers []string
+	data := encodePNG(t, testImage(8, 8))
+	f.handle(http.MethodGet, "/img/hotlinked.png", func(w http.ResponseWriter, r *http.Request) {
+		referers = append(referers, r.Header.Get("Referer"))
+		if r.Header.Get("Referer") == "" {
+			http.Error(w, "no hotlinking", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(data)
+	})
+
+	got, err := downloadImage(f.url("/img/hotlinked.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded the wrong bytes")
+	}
+	if want := []string{"", "https://instance.example.com"}; !reflect.DeepEqual(referers, want) {
+		t.Errorf("requests had Referers %q, want %q", referers, want)
+	}
+}
+
+func TestDownloadConfiguredReferer(t *testing.T) {
+	f, _ := newFakeInstance(t)
+	withConfig(t, func(c *Config) { c.Image.Referer = "https://referer.example.com" })
+
+	requests := 0
+	f.handle(http.MethodGet, "/img/forbidden.png", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Referer") != "https://referer.example.com" {
+			t.Errorf("sent Referer %q", r.Header.Get("Referer"))
+		}
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+
+	if _, err := downloadImage(f.url("/img/forbidden.png")); err == nil {
+		t.Error("forbidden download didn't fail")
+	}
+	if requests != 1 {
+		t.Errorf("made %d requests, want no retry with a configured Referer", requests)
+	}
+}
+
+// imageMention is a mention with n images attached, all served by f.
+func imageMention(t *testing.T, f *fakeInstance, id, content string, n int) *mastodon.Notification {
+	t.Helper()
+	notification := mention(id, "alice", content)
+	for i := 0; i < n; i++ {
+		path := fmt.Sprintf("/media/%s-%d.png", id, i)
+		url := f.serveFile(path, "image/png", encodePNG(t, testImage(24+i, 16)))
+		notification.Status.MediaAttachments = append(notification.Status.MediaAttachments, mastodon.Attachment{Type: "image", URL: url})
+	}
+	return notification
+}
+
+func TestReplyCap(t *testing.T) {
+	f, client := newFakeInstance(t)
+	withConfig(t, func(c *Config) { c.Reply.MaxReplies = 2 })
+
+	handleMention(client, imageMention(t, f, "1", "<p>@bot</p>", 10))
+
+	posts := f.posted()
+	if len(posts) != 2 {
+		t.Fatalf("posted %d replies, want 2", len(posts))
+	}
+	for i, post := range posts {
+		if n := len(post["media_ids[]"]); n != mediaPerReply {
+			t.Errorf("reply %d has %d images, want %d", i+1, n, mediaPerReply)
+		}
+	}
+	if len(f.uploaded()) != 8 {
+		t.Errorf("uploaded %d images, want 8", len(f.uploaded()))
+	}
+	if !strings.Contains(posts[0].Get("status")+posts[1].Get("status"), "I only do 8 images per mention, so I skipped the other 2.") {
+		t.Errorf("replies %q and %q don't mention the skipped images", posts[0].Get("status"), posts[1].Get("status"))
+	}
+}
+
+func TestHTMLPageRefused(t *testing.T) {
+	f, client := newFakeInstance(t)
+
+	page := []byte("<!DOCTYPE html><html><head><title>A photo</title></head><body><img src=\"/photo.jpg\"></body></html>")
+	notification := mention("1", "alice", "<p>@bot</p>")
+	notification.Status.MediaAttachments = []mastodon.Attachment{
+		{Type: "image", URL: f.serveFile("/photo/page", "text/html; charset=utf-8", page)},
+	}
+	handleMention(client, notification)
+
+	posts := f.posted()
+	if len(posts) != 1 || !strings.Contains(posts[0].Get("status"), "That link isn't a direct image.") {
+		t.Fatalf("replied %v, want one saying the link isn't an image", posts)
+	}
+
+	// Pages served with an image's content type are caught by sniffing.
+	if _, err := downloadImage(f.serveFile("/photo/lying.png", "image/png", page)); !errors.Is(err, errNotAnImage) {
+		t.Errorf("HTML served as image/png gave %v", err)
+	}
+}
+
+func TestMalformedMentionsIgnored(t *testing.T) {
+	f, client := newFakeInstance(t)
+
+	for name, broken := range map[string]func(n *mastodon.Notification){
+		"no status":      func(n *mastodon.Notification) { n.Status = nil },
+		"no ID":          func(n *mastodon.Notification) { n.Status.ID = "" },
+		"no URL":         func(n *mastodon.Notification) { n.Status.URI, n.Status.URL = "", "" },
+		"no author":      func(n *mastodon.Notification) { n.Account = mastodon.Account{} },
+		"no visibility":  func(n *mastodon.Notification) { n.Status.Visibility = "" },
+		"odd visibility": func(n *mastodon.Notification) { n.Status.Visibility = "limited" },
+	} {
+		notification := imageMention(t, f, "1", "<p>@bot</p>", 1)
+		broken(notification)
+		if validateMention(notification) == nil {
+			t.Errorf("mention with %s passed validation", name)
+		}
+		handleMention(client, notification)
+	}
+	if posts := f.posted(); len(posts) != 0 {
+		t.Errorf("replied to malformed mentions: %v", posts)
+	}
+
+	if err := validateMention(mention("2", "alice", "<p>@bot</p>")); err != nil {
+		t.Errorf("a well-formed mention failed validation: %v", err)
+	}
+}
+
+func TestMinimumOutputSize(t *testing.T) {
+	img := testImage(64, 64)
+	tiny := encodeJPEGData(t, img, 1)
+	minimum := len(encodeJPEGData(t, img, 30))
+	withConfig(t, func(c *Config) { c.Image.MinOutputBytes = minimum })
+
+	res, err := compress(img, options{Quality: 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Data) < minimum {
+		t.Errorf("output is %d bytes, under the %d minimum", len(res.Data), minimum)
+	}
+	if len(res.Data) > minimum*3/2 {
+		t.Errorf("output is %d bytes, bumped well past the %d minimum", len(res.Data), minimum)
+	}
+	if !strings.Contains(res.Note, "nudged the quality up") {
+		t.Errorf("note %q doesn't say the quality was bumped", res.Note)
+	}
+
+	// Outputs already big enough are left as they are.
+	withConfig(t, func(c *Config) { c.Image.MinOutputBytes = len(tiny) })
+	res, err = compress(img, options{Quality: 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res.Data, tiny) || res.Note != "" {
+		t.Errorf("output at the minimum was re-encoded to %d bytes with note %q", len(res.Data), res.Note)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// pixelDensity is the resolution stored in a JFIF header.
+type pixelDensity struct {
+	units byte // 0 for just an aspect ratio, 1 for dots per inch, 2 per cm
+	x, y  uint16
+}
+
+// aspectOnly is the density written by the "minimal" policy: square pixels
+// and nothing else.
+var aspectOnly = pixelDensity{units: 0, x: 1, y: 1}
+
+// sourceDensity reads the resolution of a JPEG (from its JFIF header) or a
+// PNG (from its pHYs chunk), if it has one.
+func sourceDensity(data []byte) (pixelDensity, bool) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8, 0xff, 0xe0}) && len(data) >= 18 &&
+		bytes.Equal(data[6:11], []byte("JFIF\x00")):
+		d := pixelDensity{units: data[13], x: binary.BigEndian.Uint16(data[14:]), y: binary.BigEndian.Uint16(data[16:])}
+		return d, d.units != 0
+
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		for i := 8; i+8 <= len(data); {
+			length := int(binary.BigEndian.Uint32(data[i:]))
+			chunk := string(data[i+4 : i+8])
+			if chunk == "pHYs" && length == 9 && i+17 <= len(data) && data[i+16] == 1 {
+				// Pixels per metre, which JFIF can only hold as per cm.
+				x := binary.BigEndian.Uint32(data[i+8:]) / 100
+				y := binary.BigEndian.Uint32(data[i+12:]) / 100
+				if x == 0 || y == 0 || x > 0xffff || y > 0xffff {
+					return pixelDensity{}, false
+				}
+				return pixelDensity{units: 2, x: uint16(x), y: uint16(y)}, true
+			}
+			if chunk == "IDAT" {
+				break
+			}
+			i += 12 + length
+		}
+	}
+	return pixelDensity{}, false
+}
+
+// applyMetadataPolicy adds whatever metadata the configured policy keeps to
+// a JPEG result. The encoder writes none, so "strip" leaves it as it is.
+func applyMetadataPolicy(res result, source pixelDensity, hasDensity bool) result {
+	if res.Format != "jpeg" || !bytes.HasPrefix(res.Data, []byte{0xff, 0xd8}) {
+		return res
+	}
+
+	var density pixelDensity
+	switch config.Image.Metadata {
+	case "minimal":
+		density = aspectOnly
+	case "dpi":
+		density = aspectOnly
+		if hasDensity {
+			density = source
+		}
+	default:
+		return res
+	}
+
+	data := make([]byte, 0, len(res.Data)+18)
+	data = append(data, res.Data[:2]...)
+	data = append(data, jfifSegment(density)...)
+	data = append(data, res.Data[2:]...)
+	res.Data = data
+	return res
+}
+
+// jfifSegment builds a JFIF 1.02 APP0 segment without a thumbnail.
+func jfifSegment(d pixelDensity) []byte {
+	return []byte{
+		0xff, 0xe0, 0, 16,
+		'J', 'F', 'I', 'F', 0,
+		1, 2,
+		d.units,
+		byte(d.x >> 8), byte(d.x),
+		byte(d.y >> 8), byte(d.y),
+		0, 0,
+	}
+}
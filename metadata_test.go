@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"image/jpeg"
+	"testing"
+)
+
+func TestMetadataPolicies(t *testing.T) {
+	plain := encodeJPEGData(t, testImage(32, 32), 90)
+	printed := append([]byte{0xff, 0xd8}, jfifSegment(pixelDensity{units: 1, x: 300, y: 300})...)
+	printed = append(printed, plain[2:]...)
+
+	crunchWith := func(policy string, source []byte) []byte {
+		withConfig(t, func(c *Config) { c.Image.Metadata = policy })
+		d, err := decodeStage(source, options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := encodeStage(d, options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(results[0].Data)); err != nil {
+			t.Fatalf("%s output doesn't decode: %v", policy, err)
+		}
+		return results[0].Data
+	}
+	hasJFIF := func(data []byte) bool {
+		return bytes.HasPrefix(data, []byte{0xff, 0xd8, 0xff, 0xe0}) && bytes.Equal(data[6:11], []byte("JFIF\x00"))
+	}
+
+	if out := crunchWith("strip", printed); bytes.Contains(out, []byte("JFIF")) {
+		t.Error("strip kept a JFIF header")
+	}
+
+	out := crunchWith("minimal", printed)
+	if !hasJFIF(out) {
+		t.Fatal("minimal wrote no JFIF header")
+	}
+	if _, ok := sourceDensity(out); ok {
+		t.Error("minimal kept the source's DPI")
+	}
+
+	out = crunchWith("dpi", printed)
+	if d, ok := sourceDensity(out); !ok || d != (pixelDensity{units: 1, x: 300, y: 300}) {
+		t.Errorf("dpi wrote density %v, want 300 dpi", d)
+	}
+
+	// Without a density to keep, dpi falls back to the minimal header.
+	out = crunchWith("dpi", plain)
+	if _, ok := sourceDensity(out); !hasJFIF(out) || ok {
+		t.Error("dpi on a source without a density didn't write the minimal header")
+	}
+}
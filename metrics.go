@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsSink is where instrumentation goes. Which one is used is picked by
+// the [metrics] sink option.
+type metricsSink interface {
+	inc(name string, labelPairs ...string)
+	observe(name string, d time.Duration, labelPairs ...string)
+}
+
+// metricsRegistry keeps a handful of counters and timing summaries and
+// serves them in the Prometheus text format.
+type metricsRegistry struct {
+	mu       sync.Mutex
+	counters map[string]float64
+	timings  map[string]*timing
+}
+
+type timing struct {
+	count int64
+	sum   float64
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		counters: make(map[string]float64),
+		timings:  make(map[string]*timing),
+	}
+}
+
+var metrics metricsSink = newMetricsRegistry()
+
+// setupMetrics replaces the default sink with the one asked for in config and
+// starts serving it if it needs a listener.
+func setupMetrics() error {
+	switch config.Metrics.Sink {
+	case "", "prometheus":
+		if config.Metrics.Listen != "" {
+			go serveMetrics(config.Metrics.Listen, metrics.(*metricsRegistry))
+		}
+	case "statsd":
+		sink, err := newStatsdSink(config.Metrics.StatsdAddr, config.Metrics.StatsdPrefix)
+		if err != nil {
+			return err
+		}
+		metrics = sink
+	default:
+		return fmt.Errorf("unknown metrics sink %q", config.Metrics.Sink)
+	}
+	return nil
+}
+
+// metricKey builds a series key such as `name{format="png"}` from a metric
+// name and label name/value pairs.
+func metricKey(name string, labelPairs ...string) string {
+	if len(labelPairs) == 0 {
+		return name
+	}
+	var labels []string
+	for i := 0; i+1 < len(labelPairs); i += 2 {
+		labels = append(labels, fmt.Sprintf("%s=%q", labelPairs[i], labelPairs[i+1]))
+	}
+	return name + "{" + strings.Join(labels, ",") + "}"
+}
+
+func (m *metricsRegistry) inc(name string, labelPairs ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[metricKey(name, labelPairs...)]++
+}
+
+func (m *metricsRegistry) observe(name string, d time.Duration, labelPairs ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := metricKey(name, labelPairs...)
+	t, ok := m.timings[key]
+	if !ok {
+		t = &timing{}
+		m.timings[key] = t
+	}
+	t.count++
+	t.sum += d.Seconds()
+}
+
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	for _, key := range sortedKeys(m.counters) {
+		fmt.Fprintf(w, "%s %g\n", key, m.counters[key])
+	}
+	for _, key := range sortedKeys(m.timings) {
+		name, labels := key, ""
+		if i := strings.IndexByte(key, '{'); i >= 0 {
+			name, labels = key[:i], key[i:]
+		}
+		t := m.timings[key]
+		fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, t.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", name, labels, t.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func serveMetrics(addr string, registry *metricsRegistry) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+	log.Printf("Serving metrics on %s/metrics", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Metrics server stopped: %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusRegistry(t *testing.T) {
+	registry := newMetricsRegistry()
+	registry.inc("jpegbot_posts_total")
+	registry.inc("jpegbot_posts_total")
+	registry.observe("jpegbot_decode_seconds", 250*time.Millisecond, "format", "png")
+	registry.observe("jpegbot_decode_seconds", 750*time.Millisecond, "format", "png")
+
+	w := httptest.NewRecorder()
+	registry.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := strings.Join([]string{
+		`jpegbot_posts_total 2`,
+		`jpegbot_decode_seconds_sum{format="png"} 1`,
+		`jpegbot_decode_seconds_count{format="png"} 2`,
+	}, "\n") + "\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("served\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestSetupMetricsSink(t *testing.T) {
+	saved := metrics
+	t.Cleanup(func() { metrics = saved })
+
+	withConfig(t, func(c *Config) {
+		c.Metrics.Sink = "statsd"
+		c.Metrics.StatsdAddr = "127.0.0.1:8125"
+	})
+	if err := setupMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := metrics.(*statsdSink); !ok {
+		t.Errorf("sink is %T, want statsd", metrics)
+	}
+
+	withConfig(t, func(c *Config) { c.Metrics.Sink = "carrier pigeon" })
+	if err := setupMetrics(); err == nil {
+		t.Error("unknown sink was accepted")
+	}
+}
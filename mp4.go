@@ -0,0 +1,65 @@
+//go:build mp4
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+func init() {
+	progressionEncoders["mp4"] = encodeProgressionMP4
+}
+
+// encodeProgressionMP4 renders the generations as an H.264 video with
+// ffmpeg, which has to be on the PATH.
+func encodeProgressionMP4(frames []image.Image) (result, error) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return result{}, fmt.Errorf("ffmpeg isn't installed: %w", err)
+	}
+
+	dir, err := os.MkdirTemp("", "jpeg-bot-progression")
+	if err != nil {
+		return result{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	for i, frame := range frames {
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("%03d.png", i)))
+		if err != nil {
+			return result{}, err
+		}
+		err = png.Encode(f, frame)
+		f.Close()
+		if err != nil {
+			return result{}, fmt.Errorf("error writing frame %d: %w", i, err)
+		}
+	}
+
+	out := filepath.Join(dir, "progression.mp4")
+	cmd := exec.CommandContext(ctx, ffmpeg,
+		"-loglevel", "error",
+		"-framerate", "10/3", // generationDelay
+		"-i", filepath.Join(dir, "%03d.png"),
+		// Hold the last generation like the GIF does.
+		"-vf", "tpad=stop_mode=clone:stop_duration=2,pad=ceil(iw/2)*2:ceil(ih/2)*2",
+		"-c:v", "libx264",
+		"-pix_fmt", "yuv420p",
+		"-movflags", "+faststart",
+		out,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return result{}, fmt.Errorf("ffmpeg failed: %w: %s", err, output)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		return result{}, err
+	}
+	return result{Data: data, Format: "mp4"}, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"image"
+	"log"
+)
+
+const (
+	defaultNSFWThreshold = 0.8
+	defaultNSFWSpoiler   = "Possibly sensitive image"
+)
+
+// NSFWClassifier scores how likely an image is to need hiding behind a
+// content warning, from 0 (safe) to 1. The bot doesn't ship a real one;
+// operators who want one assign theirs to nsfwClassifier.
+type NSFWClassifier interface {
+	Score(img image.Image) (float64, error)
+}
+
+type noopClassifier struct{}
+
+func (noopClassifier) Score(image.Image) (float64, error) { return 0, nil }
+
+var nsfwClassifier NSFWClassifier = noopClassifier{}
+
+// isSensitive reports whether the classifier scores img at or above
+// nsfw_threshold. Classifier errors count as not sensitive.
+func isSensitive(img image.Image) bool {
+	score, err := nsfwClassifier.Score(img)
+	if err != nil {
+		log.Printf("Error classifying image: %v", err)
+		return false
+	}
+	threshold := config.Image.NSFWThreshold
+	if threshold <= 0 {
+		threshold = defaultNSFWThreshold
+	}
+	return score >= threshold
+}
+
+func nsfwSpoiler() string {
+	if config.Image.NSFWSpoiler != "" {
+		return config.Image.NSFWSpoiler
+	}
+	return defaultNSFWSpoiler
+}
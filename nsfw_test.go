@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"testing"
+)
+
+// stubClassifier gives every image the same score.
+type stubClassifier struct {
+	score float64
+	err   error
+}
+
+func (s stubClassifier) Score(image.Image) (float64, error) { return s.score, s.err }
+
+func withClassifier(t *testing.T, c NSFWClassifier) {
+	t.Helper()
+	saved := nsfwClassifier
+	t.Cleanup(func() { nsfwClassifier = saved })
+	nsfwClassifier = c
+}
+
+func TestNSFWClassifier(t *testing.T) {
+	f, client := newFakeInstance(t)
+	withConfig(t, func(c *Config) {
+		c.Image.NSFWThreshold = 0.8
+		c.Image.NSFWSpoiler = "Might be lewd"
+	})
+
+	for i, tt := range []struct {
+		classifier NSFWClassifier
+		sensitive  bool
+	}{
+		{stubClassifier{score: 0.95}, true},
+		{stubClassifier{score: 0.8}, true},
+		{stubClassifier{score: 0.3}, false},
+		{stubClassifier{score: 1, err: errors.New("model not loaded")}, false},
+	} {
+		withClassifier(t, tt.classifier)
+		handleMention(client, imageMention(t, f, fmt.Sprint(i+1), "<p>@bot</p>", 1))
+
+		posts := f.posted()
+		post := posts[len(posts)-1]
+		if got := post.Get("sensitive") == "true"; got != tt.sensitive {
+			t.Errorf("%+v: reply sensitive = %v, want %v", tt.classifier, got, tt.sensitive)
+		}
+		wantSpoiler := ""
+		if tt.sensitive {
+			wantSpoiler = "Might be lewd"
+		}
+		if got := post.Get("spoiler_text"); got != wantSpoiler {
+			t.Errorf("%+v: reply has content warning %q, want %q", tt.classifier, got, wantSpoiler)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strings"
+)
+
+const defaultPaletteColors = 5
+
+// maxSamples is roughly how many pixels sampleStep lets a scan visit.
+const maxSamples = 250000
+
+// sampleStep is the grid spacing, in both directions, that keeps a scan of
+// bounds to about maxSamples pixels. The step applies to both axes, so it
+// grows with the square root of the area.
+func sampleStep(bounds image.Rectangle) int {
+	pixels := bounds.Dx() * bounds.Dy()
+	if pixels <= maxSamples {
+		return 1
+	}
+	return max(1, int(math.Sqrt(float64(pixels)/maxSamples)))
+}
+
+// dominantColors quantizes img to 4 bits per channel and returns the average
+// colour of the n most common buckets, most common first. Large images are
+// sampled on a grid to keep this cheap.
+func dominantColors(img image.Image, n int) []string {
+	type bucket struct {
+		key        int
+		count      int
+		rs, gs, bs int // channel sums, for averaging
+	}
+	buckets := make(map[int]*bucket)
+
+	bounds := img.Bounds()
+	step := sampleStep(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a < 0x8000 {
+				continue
+			}
+			r8, g8, b8 := int(r>>8), int(g>>8), int(b>>8)
+			key := (r8>>4)<<8 | (g8>>4)<<4 | b8>>4
+			bk, ok := buckets[key]
+			if !ok {
+				bk = &bucket{key: key}
+				buckets[key] = bk
+			}
+			bk.count++
+			bk.rs += r8
+			bk.gs += g8
+			bk.bs += b8
+		}
+	}
+
+	sorted := make([]*bucket, 0, len(buckets))
+	for _, bk := range buckets {
+		sorted = append(sorted, bk)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].count != sorted[j].count {
+			return sorted[i].count > sorted[j].count
+		}
+		return sorted[i].key < sorted[j].key
+	})
+
+	var colors []string
+	for i := 0; i < len(sorted) && i < n; i++ {
+		bk := sorted[i]
+		colors = append(colors, fmt.Sprintf("#%02x%02x%02x", bk.rs/bk.count, bk.gs/bk.count, bk.bs/bk.count))
+	}
+	return colors
+}
+
+func paletteNote(img image.Image) string {
+	n := config.Effects.Palette.Colors
+	if n <= 0 {
+		n = defaultPaletteColors
+	}
+	colors := dominantColors(img, n)
+	if len(colors) == 0 {
+		return ""
+	}
+	return "Dominant colors: " + strings.Join(colors, ", ")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"reflect"
+	"testing"
+)
+
+func TestDominantColors(t *testing.T) {
+	// Half red, a third blue and a sixth white.
+	img := image.NewRGBA(image.Rect(0, 0, 60, 10))
+	draw.Draw(img, image.Rect(0, 0, 30, 10), image.NewUniform(color.RGBA{200, 10, 10, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(30, 0, 50, 10), image.NewUniform(color.RGBA{20, 40, 220, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(50, 0, 60, 10), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	want := []string{"#c80a0a", "#1428dc", "#ffffff"}
+	if got := dominantColors(img, 5); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := dominantColors(img, 2); !reflect.DeepEqual(got, want[:2]) {
+		t.Errorf("asking for two colours got %v", got)
+	}
+
+	withConfig(t, func(c *Config) { c.Effects.Palette.Colors = 1 })
+	if got, want := paletteNote(img), "Dominant colors: #c80a0a"; got != want {
+		t.Errorf("note is %q, want %q", got, want)
+	}
+}
+
+func TestDominantColorsSkipsTransparency(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	img.SetRGBA(0, 0, color.RGBA{0, 255, 0, 255})
+	if got := dominantColors(img, 3); !reflect.DeepEqual(got, []string{"#00ff00"}) {
+		t.Errorf("got %v, want only the opaque pixel's colour", got)
+	}
+}
+
+func TestSampleStep(t *testing.T) {
+	tests := []struct {
+		w, h int
+		want int
+	}{
+		{500, 500, 1},
+		{501, 500, 1},
+		{2000, 2000, 4},
+		{10000, 100, 2},
+		{8000, 6000, 13},
+	}
+	for _, tt := range tests {
+		step := sampleStep(image.Rect(0, 0, tt.w, tt.h))
+		if step != tt.want {
+			t.Errorf("%dx%d sampled every %d pixels, want %d", tt.w, tt.h, step, tt.want)
+		}
+		if samples := ((tt.w + step - 1) / step) * ((tt.h + step - 1) / step); samples < maxSamples/4 && tt.w*tt.h >= maxSamples {
+			t.Errorf("%dx%d only gets %d samples", tt.w, tt.h, samples)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"image"
+)
+
+const (
+	defaultPanoramaMaxDimension = 4096
+	maxPanoramaTiles            = 8
+)
+
+// splitPanorama applies the configured panorama handling to images more
+// than max_aspect_ratio times longer than they are wide (or the other way
+// round). Depending on the panorama setting they're shrunk, cut into pieces
+// that are each crunched separately, or refused.
+func splitPanorama(d decodedImage) ([]decodedImage, error) {
+	maxRatio := config.Image.MaxAspectRatio
+	img := d.img
+	if d.anim != nil {
+		img = d.anim.Frames[0]
+	}
+	b := img.Bounds()
+	long, short := max(b.Dx(), b.Dy()), min(b.Dx(), b.Dy())
+	if maxRatio <= 0 || short == 0 || float64(long)/float64(short) <= maxRatio {
+		return []decodedImage{d}, nil
+	}
+
+	switch config.Image.Panorama {
+	case "reject":
+		return nil, fmt.Errorf("that image is %dx%d, which is more stretched than the %g:1 I take", b.Dx(), b.Dy(), maxRatio)
+
+	case "tile":
+		if d.anim != nil {
+			break
+		}
+		n := clampInt(int(float64(long)/(float64(short)*maxRatio))+1, 2, maxPanoramaTiles)
+		sub, ok := d.img.(interface {
+			SubImage(r image.Rectangle) image.Image
+		})
+		if !ok {
+			break
+		}
+
+		var parts []decodedImage
+		for i := 0; i < n; i++ {
+			tile := image.Rect(b.Min.X+b.Dx()*i/n, b.Min.Y, b.Min.X+b.Dx()*(i+1)/n, b.Max.Y)
+			if b.Dy() > b.Dx() {
+				tile = image.Rect(b.Min.X, b.Min.Y+b.Dy()*i/n, b.Max.X, b.Min.Y+b.Dy()*(i+1)/n)
+			}
+			part := d
+			part.img = sub.SubImage(tile)
+			part.note = ""
+			parts = append(parts, part)
+		}
+		parts[0].note = d.note
+		parts[0].addNote(fmt.Sprintf("That's a panorama, so I cut it into %d pieces.", n))
+		return parts, nil
+	}
+
+	// Shrinking is the default, and what animations get when tiling was
+	// asked for, every frame alike.
+	maxDimension := config.Image.PanoramaMaxDimension
+	if maxDimension <= 0 {
+		maxDimension = defaultPanoramaMaxDimension
+	}
+	if long <= maxDimension {
+		return []decodedImage{d}, nil
+	}
+	if d.anim != nil {
+		shrunk := *d.anim
+		shrunk.Frames = make([]*image.RGBA, len(d.anim.Frames))
+		for i, frame := range d.anim.Frames {
+			shrunk.Frames[i] = toRGBA(downscale(frame, maxDimension))
+		}
+		d.anim = &shrunk
+		img = shrunk.Frames[0]
+	} else {
+		d.img = downscale(d.img, maxDimension)
+		img = d.img
+	}
+	nb := img.Bounds()
+	d.addNote(fmt.Sprintf("That's a panorama, so I shrank it to %dx%d.", nb.Dx(), nb.Dy()))
+	return []decodedImage{d}, nil
+}
+
+func (d *decodedImage) addNote(note string) {
+	if d.note != "" {
+		d.note += " "
+	}
+	d.note += note
+}
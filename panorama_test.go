@@ -0,0 +1,123 @@
+package main
+
+import (
+	"image"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPanoramaHandling(t *testing.T) {
+	wide := decodedImage{img: testImage(2000, 100)}
+	withConfig(t, func(c *Config) {
+		c.Image.MaxAspectRatio = 4
+		c.Image.PanoramaMaxDimension = 500
+	})
+
+	withConfig(t, func(c *Config) { c.Image.Panorama = "downscale" })
+	parts, err := splitPanorama(wide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 1 || parts[0].img.Bounds().Dx() != 500 || parts[0].img.Bounds().Dy() != 25 {
+		t.Errorf("downscale gave %d parts of %v, want one 500x25", len(parts), parts[0].img.Bounds())
+	}
+	if !strings.Contains(parts[0].note, "shrank it to 500x25") {
+		t.Errorf("downscale note is %q", parts[0].note)
+	}
+
+	withConfig(t, func(c *Config) { c.Image.Panorama = "tile" })
+	for _, tt := range []struct {
+		w, h, tiles int
+	}{
+		{2000, 100, 6},
+		{100, 2000, 6},
+		{10000, 100, maxPanoramaTiles},
+	} {
+		parts, err := splitPanorama(decodedImage{img: testImage(tt.w, tt.h)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parts) != tt.tiles {
+			t.Errorf("%dx%d was cut into %d tiles, want %d", tt.w, tt.h, len(parts), tt.tiles)
+			continue
+		}
+		// The tiles cover the whole image along its long side.
+		covered := 0
+		for _, part := range parts {
+			b := part.img.Bounds()
+			if tt.w > tt.h {
+				covered += b.Dx()
+				if b.Dy() != tt.h {
+					t.Errorf("tile %v isn't the image's full height", b)
+				}
+			} else {
+				covered += b.Dy()
+				if b.Dx() != tt.w {
+					t.Errorf("tile %v isn't the image's full width", b)
+				}
+			}
+		}
+		if covered != max(tt.w, tt.h) {
+			t.Errorf("%dx%d tiles cover %dpx, want %d", tt.w, tt.h, covered, max(tt.w, tt.h))
+		}
+		if !strings.Contains(parts[0].note, "pieces") {
+			t.Errorf("first tile's note is %q", parts[0].note)
+		}
+	}
+
+	withConfig(t, func(c *Config) { c.Image.Panorama = "reject" })
+	if _, err := splitPanorama(wide); err == nil || !strings.Contains(err.Error(), "2000x100") {
+		t.Errorf("reject gave %v", err)
+	}
+
+	// Images within the ratio aren't touched.
+	normal := decodedImage{img: testImage(400, 100)}
+	if parts, err := splitPanorama(normal); err != nil || len(parts) != 1 || parts[0].img != normal.img {
+		t.Errorf("a 4:1 image gave %d parts, %v", len(parts), err)
+	}
+}
+
+func TestAnimatedPanorama(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.Image.MaxAspectRatio = 4
+		c.Image.PanoramaMaxDimension = 500
+	})
+	anim := &animation{Delays: []int{10, 20, 30}}
+	for range anim.Delays {
+		anim.Frames = append(anim.Frames, testImage(2000, 100))
+	}
+	d := decodedImage{anim: anim}
+
+	// Tiling doesn't work on animations, so they're shrunk either way.
+	for _, policy := range []string{"downscale", "tile"} {
+		withConfig(t, func(c *Config) { c.Image.Panorama = policy })
+		parts, err := splitPanorama(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parts) != 1 || parts[0].anim == nil {
+			t.Fatalf("%s gave %d parts, want one animation", policy, len(parts))
+		}
+		shrunk := parts[0].anim
+		if len(shrunk.Frames) != 3 || !reflect.DeepEqual(shrunk.Delays, anim.Delays) {
+			t.Errorf("%s gave %d frames with delays %v, want the original 3", policy, len(shrunk.Frames), shrunk.Delays)
+		}
+		for i, frame := range shrunk.Frames {
+			if got := frame.Bounds().Size(); got != image.Pt(500, 25) {
+				t.Errorf("%s frame %d is %v, want 500x25", policy, i+1, got)
+			}
+		}
+		if !strings.Contains(parts[0].note, "shrank it to 500x25") {
+			t.Errorf("%s note is %q", policy, parts[0].note)
+		}
+	}
+	if anim.Frames[0].Bounds().Dx() != 2000 {
+		t.Error("shrinking changed the original animation")
+	}
+
+	withConfig(t, func(c *Config) { c.Image.Panorama = "reject" })
+	if _, err := splitPanorama(d); err == nil {
+		t.Error("reject accepted an animated panorama")
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"strings"
+	"time"
+)
+
+// decodedImage is the output of the decode stage: a still or an animation,
+// ready to be encoded.
+type decodedImage struct {
+	img            image.Image
+	anim           *animation
+	format         string
+	originalLength int
+	note           string
+	decodeTime     time.Duration
+	density        pixelDensity
+	hasDensity     bool
+	sourceQuality  int // estimated quality of a JPEG source, 0 if unknown
+}
+
+// processImages downloads, decodes and encodes each image, calling done with
+// each result in the original order. Up to pipeline_depth images are
+// downloaded and decoded in the background while the current one encodes.
+func processImages(imageURLs []string, opts options, done func(result, error)) {
+	encode := func(d decodedImage) {
+		parts, err := splitPanorama(d)
+		if err != nil {
+			done(result{}, err)
+			return
+		}
+		for _, part := range parts {
+			results, err := encodeStage(part, opts)
+			if err != nil {
+				done(result{}, err)
+				continue
+			}
+			for _, res := range results {
+				done(res, nil)
+			}
+		}
+	}
+
+	depth := config.Image.PipelineDepth
+	if depth <= 0 {
+		for _, imageURL := range imageURLs {
+			d, err := downloadAndDecode(imageURL, opts)
+			if err != nil {
+				done(result{}, err)
+				continue
+			}
+			encode(d)
+		}
+		return
+	}
+
+	type stageOutput struct {
+		decoded decodedImage
+		err     error
+	}
+
+	// One decoded image waits in the blocked send, the rest in the buffer.
+	decoded := make(chan stageOutput, depth-1)
+	go func() {
+		defer close(decoded)
+		for _, imageURL := range imageURLs {
+			d, err := downloadAndDecode(imageURL, opts)
+			decoded <- stageOutput{decoded: d, err: err}
+		}
+	}()
+
+	for out := range decoded {
+		if out.err != nil {
+			done(result{}, out.err)
+			continue
+		}
+		encode(out.decoded)
+	}
+}
+
+var errBlockedImage = errors.New("image is on the blocklist")
+
+var errCorruptImage = errors.New("the image came through corrupted, try again later")
+
+// downloadAndDecode fetches and decodes an image, downloading it a second
+// time if the first decode looks corrupt.
+func downloadAndDecode(imageURL string, opts options) (decodedImage, error) {
+	for attempt := 1; ; attempt++ {
+		imgData, err := downloadImage(imageURL)
+		if err != nil {
+			return decodedImage{}, err
+		}
+		d, err := decodeStage(imgData, opts)
+		if err != nil || !looksCorrupt(d) {
+			return d, err
+		}
+		if attempt == 2 {
+			return decodedImage{}, errCorruptImage
+		}
+		log.Printf("Decode of %s looks corrupt, downloading it again", imageURL)
+	}
+}
+
+// isBlocked reports whether the SHA-256 of the source bytes is one of the
+// configured blocked hashes.
+func isBlocked(imgData []byte) bool {
+	sum := sha256.Sum256(imgData)
+	hash := hex.EncodeToString(sum[:])
+	for _, blocked := range config.Image.BlockedHashes {
+		if strings.EqualFold(strings.TrimSpace(blocked), hash) {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeStage(imgData []byte, opts options) (decodedImage, error) {
+	if isBlocked(imgData) {
+		return decodedImage{}, errBlockedImage
+	}
+
+	decodeStart := time.Now()
+	img, anim, format, err := decodeInput(imgData, opts)
+	if err != nil {
+		metrics.observe("jpegbot_decode_seconds", time.Since(decodeStart), "format", "unknown")
+		return decodedImage{}, fmt.Errorf("error decoding image: %w", err)
+	}
+	decodeTime := time.Since(decodeStart)
+	metrics.observe("jpegbot_decode_seconds", decodeTime, "format", format)
+
+	log.Printf("Decoded image with format: %s in %v", format, decodeTime)
+
+	d := decodedImage{img: img, anim: anim, format: format, originalLength: len(imgData), decodeTime: decodeTime}
+	d.density, d.hasDensity = sourceDensity(imgData)
+	if format == "jpeg" {
+		d.sourceQuality, _ = estimateJPEGQuality(imgData)
+	}
+	if anim != nil && (opts.Compare || opts.Generations > 0 || opts.Sizes || opts.budget(len(imgData)) > 0) {
+		d.img, d.anim = anim.Frames[0], nil
+		d.note = "Size targets, compare, generations and sizes only work on still images, so this is the first frame."
+	}
+	if d.anim != nil {
+		note, err := limitFrameRate(d.anim)
+		if err != nil {
+			return decodedImage{}, err
+		}
+		d.note = note
+	}
+	return d, nil
+}
+
+// encodeStage crunches a decoded image. That's usually a single result,
+// except with "sizes", which makes one per size.
+func encodeStage(d decodedImage, opts options) ([]result, error) {
+	crunchedNote, err := alreadyCrunchedNote(d, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	source := d.img
+	if d.anim != nil {
+		source = d.anim.Frames[0]
+	}
+	var effectsNote string
+	opts.Effects, effectsNote = usableEffects(source, opts.Effects)
+
+	encodeStart := time.Now()
+	var results []result
+	var res result
+	switch {
+	case d.anim != nil:
+		res, err = crunchAnimation(d.anim, opts)
+	case opts.Generations > 0:
+		res, err = crunchGenerations(d.img, opts)
+	case opts.Sizes:
+		results, err = encodeSizes(d.img, opts, d.originalLength)
+	default:
+		res, err = processStill(d.img, opts, d.originalLength)
+	}
+	encodeTime := time.Since(encodeStart)
+	metrics.observe("jpegbot_encode_seconds", encodeTime, "format", d.format)
+	if err != nil {
+		return nil, err
+	}
+	if results == nil {
+		results = []result{res}
+	}
+
+	log.Printf("Encoded %s image in %v", d.format, encodeTime)
+
+	sensitive := isSensitive(source)
+	for i := range results {
+		results[i] = applyMetadataPolicy(results[i], d.density, d.hasDensity)
+		results[i].Sensitive = sensitive
+	}
+
+	// Timing and notes cover everything made from the image, so they go on
+	// the first result.
+	first := &results[0]
+	first.Elapsed = d.decodeTime + encodeTime
+	first.addNote(d.note)
+	first.addNote(crunchedNote)
+	first.addNote(effectsNote)
+	if opts.Datamosh && d.anim == nil {
+		first.addNote("Datamosh only works on animated GIFs, so this is a plain crunch.")
+	}
+	if opts.Palette {
+		first.addNote(paletteNote(source))
+	}
+	return results, nil
+}
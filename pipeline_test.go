@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withMetrics swaps in a fresh registry for the length of a test.
+func withMetrics(t *testing.T) *metricsRegistry {
+	t.Helper()
+	saved := metrics
+	t.Cleanup(func() { metrics = saved })
+	registry := newMetricsRegistry()
+	metrics = registry
+	return registry
+}
+
+func TestDecodeTimingsByFormat(t *testing.T) {
+	registry := withMetrics(t)
+
+	if _, err := decodeStage(encodePNG(t, testImage(16, 16)), options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeStage(encodeJPEGData(t, testImage(16, 16), 80), options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeStage([]byte("not an image at all"), options{}); err == nil {
+		t.Fatal("garbage decoded without an error")
+	}
+
+	for _, key := range []string{
+		`jpegbot_decode_seconds{format="png"}`,
+		`jpegbot_decode_seconds{format="jpeg"}`,
+		`jpegbot_decode_seconds{format="unknown"}`,
+	} {
+		timing, ok := registry.timings[key]
+		if !ok {
+			t.Errorf("no %s recorded", key)
+			continue
+		}
+		if timing.count != 1 {
+			t.Errorf("%s recorded %d times, want 1", key, timing.count)
+		}
+	}
+}
+
+func TestPipelineOrder(t *testing.T) {
+	f, _ := newFakeInstance(t)
+	var urls []string
+	for i := 1; i <= 5; i++ {
+		urls = append(urls, f.serveFile(fmt.Sprintf("/img/%d.png", i), "image/png", encodePNG(t, testImage(8*i, 8))))
+	}
+	urls[2] = f.url("/img/missing.png")
+
+	for _, depth := range []int{0, 1, 3} {
+		t.Run(fmt.Sprint("depth ", depth), func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.Image.PipelineDepth = depth })
+
+			var widths []int
+			processImages(urls, options{}, func(res result, err error) {
+				if err != nil {
+					widths = append(widths, 0)
+					return
+				}
+				img, _, err := decodeImage(res.Data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				widths = append(widths, img.Bounds().Dx())
+			})
+
+			if want := []int{8, 16, 0, 32, 40}; !reflect.DeepEqual(widths, want) {
+				t.Errorf("results came out as widths %v, want %v", widths, want)
+			}
+		})
+	}
+}
+
+func TestBlockedHashes(t *testing.T) {
+	blocked := encodePNG(t, testImage(8, 8))
+	allowed := encodePNG(t, testImage(9, 9))
+	sum := sha256.Sum256(blocked)
+	withConfig(t, func(c *Config) {
+		c.Image.BlockedHashes = []string{" " + strings.ToUpper(hex.EncodeToString(sum[:])) + " "}
+	})
+
+	if _, err := decodeStage(blocked, options{}); !errors.Is(err, errBlockedImage) {
+		t.Errorf("blocklisted image gave %v, want errBlockedImage", err)
+	}
+	if _, err := decodeStage(allowed, options{}); err != nil {
+		t.Errorf("other image was refused: %v", err)
+	}
+	if got := failureMessage(fmt.Errorf("wrapped: %w", errBlockedImage)); got != "Sorry, I can't process that image." {
+		t.Errorf("blocklisted image is explained as %q", got)
+	}
+}
+
+func TestSequentialProcessing(t *testing.T) {
+	f, _ := newFakeInstance(t)
+	withConfig(t, func(c *Config) {
+		c.Image.Processing = "sequential"
+		c.Image.ImageDelay = 50 * time.Millisecond
+		c.Image.PipelineDepth = 3
+	})
+
+	var mu sync.Mutex
+	var downloads, finished []time.Time
+	data := encodePNG(t, testImage(16, 16))
+	var urls []string
+	for i := 0; i < 3; i++ {
+		path := fmt.Sprintf("/img/%d.png", i)
+		f.handle(http.MethodGet, path, func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			downloads = append(downloads, time.Now())
+			mu.Unlock()
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(data)
+		})
+		urls = append(urls, f.url(path))
+	}
+
+	processAll(urls, options{}, func(res result, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		finished = append(finished, time.Now())
+		mu.Unlock()
+	})
+
+	if len(downloads) != 3 || len(finished) != 3 {
+		t.Fatalf("downloaded %d and finished %d images, want 3", len(downloads), len(finished))
+	}
+	// Each image is only fetched once the one before it is done and the
+	// delay has passed, instead of being downloaded ahead.
+	for i := 1; i < 3; i++ {
+		if gap := downloads[i].Sub(finished[i-1]); gap < 50*time.Millisecond {
+			t.Errorf("image %d was fetched %v after image %d finished, want at least the 50ms delay", i+1, gap, i)
+		}
+	}
+}
+
+// roundTripFunc serves HTTP requests without a server.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// BenchmarkProcessImages measures a batch of images from a slowish host
+// strictly one after another and with downloads and decodes running ahead.
+// The host is faked in the transport, so its latency runs on the
+// downloading goroutine like a real network's would, rather than waiting
+// for an in-process server to get scheduled.
+func BenchmarkProcessImages(b *testing.B) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(256, 192)); err != nil {
+		b.Fatal(err)
+	}
+	data := buf.Bytes()
+	savedTransport := http.DefaultClient.Transport
+	b.Cleanup(func() { http.DefaultClient.Transport = savedTransport })
+	http.DefaultClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		time.Sleep(10 * time.Millisecond)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"image/png"}},
+			Body:       io.NopCloser(bytes.NewReader(data)),
+			Request:    r,
+		}, nil
+	})
+
+	var urls []string
+	for i := 0; i < 8; i++ {
+		urls = append(urls, fmt.Sprintf("https://cdn.example.com/img/%d.png", i))
+	}
+
+	// An effect gives the encode stage about as much work as a download
+	// waits, which is where running ahead pays off.
+	opts, err := parseOptions("@bot wave")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	saved := config
+	b.Cleanup(func() { config = saved })
+	for _, depth := range []int{0, 4} {
+		b.Run(fmt.Sprint("depth ", depth), func(b *testing.B) {
+			config.Image.PipelineDepth = depth
+			for i := 0; i < b.N; i++ {
+				processImages(urls, opts, func(res result, err error) {
+					if err != nil {
+						b.Fatal(err)
+					}
+				})
+			}
+		})
+	}
+}
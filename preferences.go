@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const defaultPreferencesPath = "preferences.json"
+
+// preferences are a user's saved defaults, used whenever a mention doesn't
+// say otherwise.
+type preferences struct {
+	Quality int    `json:"quality,omitempty"`
+	Format  string `json:"format,omitempty"`
+}
+
+// preferenceStore keeps everyone's preferences in a small JSON file, keyed
+// by account.
+type preferenceStore struct {
+	mu    sync.Mutex
+	path  string
+	prefs map[string]preferences
+}
+
+var prefs *preferenceStore
+
+func loadPreferences(path string) (*preferenceStore, error) {
+	s := &preferenceStore{path: path, prefs: make(map[string]preferences)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.prefs); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *preferenceStore) get(acct string) preferences {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.prefs[acct]
+}
+
+// update merges the non-zero fields of p into acct's preferences.
+func (s *preferenceStore) update(acct string, p preferences) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.prefs[acct]
+	if p.Quality != 0 {
+		current.Quality = p.Quality
+	}
+	if p.Format != "" {
+		current.Format = p.Format
+	}
+	s.prefs[acct] = current
+	return s.save()
+}
+
+func (s *preferenceStore) reset(acct string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.prefs, acct)
+	return s.save()
+}
+
+// save writes the store to a temporary file and renames it into place, so a
+// crash mid-write can't leave a truncated file behind.
+func (s *preferenceStore) save() error {
+	data, err := json.MarshalIndent(s.prefs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// applyPreferences fills in anything the mention didn't ask for explicitly
+// from the user's saved preferences. Whatever is still unset afterwards
+// falls back to the global defaults.
+func applyPreferences(opts *options, acct string) {
+	saved := prefs.get(acct)
+	if opts.Quality == 0 {
+		opts.Quality = saved.Quality
+	}
+	if opts.Format == "" {
+		opts.Format = saved.Format
+	}
+}
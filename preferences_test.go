@@ -0,0 +1,71 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPreferencesPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "preferences.json")
+
+	store, err := loadPreferences(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.update("alice", preferences{Quality: 30}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.update("alice", preferences{Format: "png"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.update("bob", preferences{Quality: 80}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.reset("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := loadPreferences(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reloaded.get("alice"), (preferences{Quality: 30, Format: "png"}); got != want {
+		t.Errorf("alice's preferences reloaded as %+v, want %+v", got, want)
+	}
+	if got := reloaded.get("bob"); got != (preferences{}) {
+		t.Errorf("bob's reset preferences reloaded as %+v", got)
+	}
+}
+
+func TestPreferencePrecedence(t *testing.T) {
+	saved := prefs
+	t.Cleanup(func() { prefs = saved })
+	var err error
+	prefs, err = loadPreferences(filepath.Join(t.TempDir(), "preferences.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := prefs.update("alice", preferences{Quality: 30, Format: "png"}); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, func(c *Config) { c.Image.Quality = 10 })
+
+	// The mention beats saved preferences, which beat the config.
+	opts := options{Quality: 60}
+	applyPreferences(&opts, "alice")
+	if opts.Quality != 60 || opts.Format != "png" {
+		t.Errorf("explicit quality with saved format gave %+v", opts)
+	}
+
+	opts = options{}
+	applyPreferences(&opts, "alice")
+	if opts.quality() != 30 {
+		t.Errorf("saved quality gave %d, want 30", opts.quality())
+	}
+
+	opts = options{}
+	applyPreferences(&opts, "bob")
+	if opts.quality() != 10 || opts.Format != "" {
+		t.Errorf("no preferences gave quality %d and format %q, want the config's 10", opts.quality(), opts.Format)
+	}
+}
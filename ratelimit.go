@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultRateLimitHeadroom = 0.1
+
+// rateLimitTransport watches the rate limit headers on the instance's
+// responses and, once the remaining budget drops below the configured
+// headroom, spaces requests out so the rest lasts until the limit resets
+// instead of running into 429s.
+type rateLimitTransport struct {
+	base http.RoundTripper
+
+	mu        sync.Mutex
+	limit     int
+	remaining int
+	reset     time.Time
+}
+
+func newRateLimitTransport(base http.RoundTripper) *rateLimitTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &rateLimitTransport{base: base}
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if delay := t.delay(time.Now()); delay > 0 {
+		log.Printf("Rate limit headroom is low, waiting %v before %s", delay.Round(time.Millisecond), req.URL.Path)
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err == nil {
+		t.update(resp.Header)
+	}
+	return resp, err
+}
+
+// update records the budget from a response's rate limit headers, if it has
+// them.
+func (t *rateLimitTransport) update(header http.Header) {
+	limit, err := strconv.Atoi(header.Get("X-RateLimit-Limit"))
+	if err != nil {
+		return
+	}
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := time.Parse(time.RFC3339Nano, header.Get("X-RateLimit-Reset"))
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.limit, t.remaining, t.reset = limit, remaining, reset
+}
+
+// delay is how long to hold off the next request. With plenty of budget left
+// it's nothing; below the headroom, the time until the reset is shared out
+// evenly between the requests remaining.
+func (t *rateLimitTransport) delay(now time.Time) time.Duration {
+	headroom := config.Server.RateLimitHeadroom
+	if headroom == 0 {
+		headroom = defaultRateLimitHeadroom
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if headroom < 0 || t.limit == 0 || !now.Before(t.reset) {
+		return 0
+	}
+	if float64(t.remaining) >= headroom*float64(t.limit) {
+		return 0
+	}
+	return t.reset.Sub(now) / time.Duration(t.remaining+1)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func rateLimitHeader(limit, remaining int, reset time.Time) http.Header {
+	h := http.Header{}
+	h.Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("X-RateLimit-Reset", reset.Format(time.RFC3339Nano))
+	return h
+}
+
+func TestRateLimitDelay(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Server.RateLimitHeadroom = 0.1 })
+	now := time.Now()
+	reset := now.Add(time.Minute)
+
+	for _, tt := range []struct {
+		remaining int
+		want      time.Duration
+	}{
+		{300, 0},
+		{30, 0},
+		{29, 2 * time.Second},
+		{5, 10 * time.Second},
+		{0, time.Minute},
+	} {
+		rt := newRateLimitTransport(nil)
+		rt.update(rateLimitHeader(300, tt.remaining, reset))
+		if got := rt.delay(now); got != tt.want {
+			t.Errorf("with %d of 300 left, delay is %v, want %v", tt.remaining, got, tt.want)
+		}
+	}
+
+	rt := newRateLimitTransport(nil)
+	rt.update(rateLimitHeader(300, 0, reset))
+	if got := rt.delay(reset.Add(time.Second)); got != 0 {
+		t.Errorf("delay after the reset is %v, want none", got)
+	}
+
+	// Responses without the headers leave the budget alone.
+	rt.update(http.Header{})
+	if got := rt.delay(now); got != time.Minute {
+		t.Errorf("a response without rate limit headers changed the delay to %v", got)
+	}
+
+	withConfig(t, func(c *Config) { c.Server.RateLimitHeadroom = -1 })
+	if got := rt.delay(now); got != 0 {
+		t.Errorf("negative headroom still delays by %v", got)
+	}
+}
+
+func TestRateLimitTransportSlowsDown(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Server.RateLimitHeadroom = 0.1 })
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range rateLimitHeader(300, 1, time.Now().Add(400*time.Millisecond)) {
+			w.Header()[k] = v
+		}
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: newRateLimitTransport(nil)}
+
+	get := func() time.Duration {
+		start := time.Now()
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return time.Since(start)
+	}
+	get()
+	// One request left until the reset, so the next waits about half of it.
+	if took := get(); took < 150*time.Millisecond {
+		t.Errorf("request with the budget nearly spent went out after %v", took)
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+const defaultMaxReplyLength = 500
+
+// replyText is a reply split into the parts that can be sacrificed to fit
+// within the instance's character limit.
+type replyText struct {
+	Mention string   // the account being replied to
+	CCs     []string // other accounts from the original post
+	Body    string
+	Footer  string
+	Tag     string // job tag for matching the reply up with the logs, never cut
+}
+
+// newReplyText builds a reply to notification's author, CCing the accounts
+// the original post mentioned if configured to.
+func newReplyText(notification *mastodon.Notification, body string) replyText {
+	r := replyText{
+		Mention: "@" + notification.Account.Acct,
+		Body:    body,
+		Footer:  config.Reply.Footer,
+	}
+	if config.Reply.Sign {
+		r.Tag = "[" + jobTag(notification) + "]"
+	}
+
+	if config.Reply.CCMentions {
+		for _, mention := range notification.Status.Mentions {
+			if mention.ID == selfID || mention.ID == notification.Account.ID {
+				continue
+			}
+			r.CCs = append(r.CCs, "@"+mention.Acct)
+		}
+	}
+
+	return r
+}
+
+// replyLanguage picks the language to tag replies to notification with: the
+// mention's own unless configured to ignore it, otherwise the configured
+// default. An empty language leaves it to the instance.
+func replyLanguage(notification *mastodon.Notification) string {
+	if !config.Reply.IgnoreLanguage && notification.Status.Language != "" {
+		return notification.Status.Language
+	}
+	return config.Reply.Language
+}
+
+func (r replyText) join() string {
+	parts := append([]string{r.Mention}, r.CCs...)
+	parts = append(parts, r.Body)
+	if r.Footer != "" {
+		parts = append(parts, r.Footer)
+	}
+	return strings.Join(parts, " ")
+}
+
+// String renders the reply, shortened to the configured limit using the
+// configured truncation strategy.
+func (r replyText) String() string {
+	// The tag is never cut, so the rest has to fit in what it leaves.
+	limit := maxReplyLength()
+	if r.Tag != "" {
+		limit -= length(r.Tag) + 1
+	}
+
+	switch config.Reply.TruncateStrategy {
+	case "drop_footer":
+		if length(r.join()) > limit {
+			r.Footer = ""
+		}
+	case "drop_ccs":
+		if length(r.join()) > limit {
+			r.CCs = nil
+		}
+	}
+
+	text := truncate(r.join(), limit)
+	if r.Tag == "" {
+		return text
+	}
+	if text == "" {
+		return r.Tag
+	}
+	return text + " " + r.Tag
+}
+
+// fits reports whether the reply fits within the configured limit as it is,
+// without anything being dropped or cut.
+func (r replyText) fits() bool {
+	n := length(r.join())
+	if r.Tag != "" {
+		n += 1 + length(r.Tag)
+	}
+	return n <= maxReplyLength()
+}
+
+func maxReplyLength() int {
+	if config.Reply.MaxLength <= 0 {
+		return defaultMaxReplyLength
+	}
+	return config.Reply.MaxLength
+}
+
+// jobTag is a short opaque tag identifying the job a notification started,
+// the same every time for the same notification.
+func jobTag(notification *mastodon.Notification) string {
+	sum := sha256.Sum256([]byte(notification.ID))
+	return hex.EncodeToString(sum[:])[:6]
+}
+
+// formatDuration renders d the way a person would write it: "320ms" or
+// "1.4s".
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	return fmt.Sprintf("%.1fs", d.Seconds())
+}
+
+func length(s string) int {
+	return len([]rune(s))
+}
+
+// truncate cuts s to at most limit characters, ending it with an ellipsis if
+// anything was removed.
+func truncate(s string, limit int) string {
+	runes := []rune(s)
+	if len(runes) <= limit {
+		return s
+	}
+	if limit <= 0 {
+		return ""
+	}
+	return string(runes[:limit-1]) + "…"
+}
+
+var errEmptyStatus = errors.New("instance returned an empty status")
+
+var errParentDeleted = errors.New("the post being replied to was deleted")
+
+// postStatus posts toot, treating a response without a status ID as a
+// failure instead of assuming it went through. If the post being replied to
+// was deleted in the meantime, the reply is either posted on its own or
+// dropped, depending on the config.
+func postStatus(client *mastodon.Client, toot *mastodon.Toot) (*mastodon.Status, error) {
+	status, err := client.PostStatus(ctx, toot)
+
+	var apiErr *mastodon.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound && toot.InReplyToID != "" {
+		if config.Reply.OnDeletedParent == "drop" {
+			log.Printf("Dropping reply, %s was deleted", toot.InReplyToID)
+			err = errParentDeleted
+		} else {
+			log.Printf("%s was deleted, posting the reply on its own", toot.InReplyToID)
+			standalone := *toot
+			standalone.InReplyToID = ""
+			status, err = client.PostStatus(ctx, &standalone)
+		}
+	}
+
+	if err == nil && (status == nil || status.ID == "") {
+		err = errEmptyStatus
+	}
+
+	if err != nil {
+		metrics.inc("jpegbot_post_failures_total")
+		return nil, err
+	}
+	metrics.inc("jpegbot_posts_total")
+	return status, nil
+}
+
+// mediaPerReply is how many attachments Mastodon allows on a single post.
+const mediaPerReply = 4
+
+const defaultMaxReplies = 2
+
+// batch is up to mediaPerReply processed images going out in one reply,
+// along with what went wrong with any others.
+type batch struct {
+	results  []result
+	failures []string
+	notes    []string
+
+	// spoiler puts the reply behind a content warning, and sensitive hides
+	// its media.
+	spoiler   string
+	sensitive bool
+}
+
+// collector gathers a mention's results into batches, handing each one to
+// send as it fills up. Sizes and panorama tiles turn one image into several
+// results, so the per-mention cap is applied here to what actually comes
+// out rather than to the images found.
+type collector struct {
+	limit     int // most results sent for the whole mention
+	spoiler   string
+	sensitive bool
+	send      func(batch)
+
+	current           batch
+	accepted, dropped int
+}
+
+func newCollector(limit int, spoiler string, sensitive bool, send func(batch)) *collector {
+	c := &collector{limit: limit, spoiler: spoiler, sensitive: sensitive, send: send}
+	c.current = c.fresh()
+	return c
+}
+
+func (c *collector) fresh() batch {
+	return batch{spoiler: c.spoiler, sensitive: c.sensitive}
+}
+
+// note adds a note to the reply currently being put together.
+func (c *collector) note(note string) {
+	c.current.notes = append(c.current.notes, note)
+}
+
+// add takes one image's result, or the error it failed with.
+func (c *collector) add(res result, err error) {
+	switch {
+	case err != nil:
+		c.current.failures = append(c.current.failures, failureMessage(err))
+	case c.accepted == c.limit:
+		c.dropped++
+	default:
+		c.accepted++
+		// A full batch is held back until there's more to send, so the
+		// last reply is still around to carry any notes.
+		if len(c.current.results) == mediaPerReply {
+			c.send(c.current)
+			c.current = c.fresh()
+		}
+		c.current.results = append(c.current.results, res)
+	}
+}
+
+// flush sends whatever is left once every image is done.
+func (c *collector) flush() {
+	if c.dropped > 0 {
+		c.note(fmt.Sprintf("That came out as more than %d images, so I left off the last %d.", c.accepted, c.dropped))
+	}
+	if len(c.current.results) > 0 || len(c.current.failures) > 0 {
+		c.send(c.current)
+	}
+	c.current = c.fresh()
+}
+
+// matchingCW picks the content warning for replies to a mention: the
+// mention's own, or else that of the post the images came from, so a CW'd
+// image doesn't come back uncovered. With ignore_cw, replies get none.
+func matchingCW(mention, source *mastodon.Status) (spoiler string, sensitive bool) {
+	if config.Reply.IgnoreCW {
+		return "", false
+	}
+	for _, status := range []*mastodon.Status{mention, source} {
+		if status == nil {
+			continue
+		}
+		if spoiler == "" {
+			spoiler = status.SpoilerText
+		}
+		sensitive = sensitive || status.Sensitive || status.SpoilerText != ""
+	}
+	return spoiler, sensitive
+}
+
+// uploadMediaAndReply posts a batch of images as a reply to notification and
+// returns the posted status, or nil if that failed and an error reply was
+// sent instead.
+func uploadMediaAndReply(client *mastodon.Client, b batch, notification *mastodon.Notification, visibility string) *mastodon.Status {
+	if len(b.results) == 0 {
+		if len(b.failures) > 0 {
+			replyWithError(client, notification, strings.Join(b.failures, " "))
+		}
+		return nil
+	}
+
+	var mediaIDs []mastodon.ID
+	var uploaded []result
+	var elapsed time.Duration
+	var notes, uploadFailures []string
+	var flagged bool
+	for i, res := range b.results {
+		res, err := ensureSupportedFormat(res, accountDomain(notification.Account.Acct))
+		if err != nil {
+			log.Printf("Error converting image %d for %s: %v", i+1, notification.Account.Acct, err)
+			uploadFailures = append(uploadFailures, fmt.Sprintf("Error converting image: %v", err))
+			continue
+		}
+
+		uploadStart := time.Now()
+		media, err := uploadResult(client, res)
+		if err == nil && (media == nil || media.ID == "") {
+			err = errors.New("the instance didn't return a media ID")
+		}
+		if err != nil {
+			log.Printf("Error uploading image %d for %s: %v", i+1, notification.Account.Acct, err)
+			uploadFailures = append(uploadFailures, fmt.Sprintf("Error uploading media: %v", err))
+			continue
+		}
+		elapsed += res.Elapsed + time.Since(uploadStart)
+
+		flagged = flagged || res.Sensitive
+		mediaIDs = append(mediaIDs, media.ID)
+		uploaded = append(uploaded, res)
+		if res.Note != "" {
+			notes = append(notes, res.Note)
+		}
+	}
+
+	// Unless configured to give up on the whole batch, whatever did upload
+	// goes out with a note about the rest.
+	if len(uploaded) == 0 || (len(uploadFailures) > 0 && config.Reply.OnPartialUpload == "fail") {
+		replyWithError(client, notification, strings.Join(append(b.failures, uploadFailures...), " "))
+		return nil
+	}
+	if len(uploadFailures) > 0 {
+		notes = append(notes, fmt.Sprintf("%d of the images didn't make it:", len(uploadFailures)))
+		notes = append(notes, uploadFailures...)
+	}
+
+	visibility = replyVisibility(visibility)
+
+	body := "Here are your compressed images!"
+	if len(uploaded) == 1 {
+		body = "Here's your compressed image!"
+		switch uploaded[0].Format {
+		case "jpeg":
+			body = "Here's your compressed JPEG!"
+		case "gif":
+			body = "Here's your compressed GIF!"
+		case "mp4":
+			body = "Here's your compression progression!"
+		}
+	}
+	for _, note := range append(append(notes, b.failures...), b.notes...) {
+		body += " " + note
+	}
+	if config.Reply.ShowTiming {
+		body += fmt.Sprintf(" (took %s)", formatDuration(elapsed))
+	}
+
+	reply := &mastodon.Toot{
+		Status:      newReplyText(notification, body).String(),
+		InReplyToID: notification.Status.ID,
+		MediaIDs:    mediaIDs,
+		Visibility:  visibility,
+		Language:    replyLanguage(notification),
+	}
+	reply.Sensitive = b.sensitive || flagged
+	reply.SpoilerText = b.spoiler
+	if flagged && reply.SpoilerText == "" {
+		reply.SpoilerText = nsfwSpoiler()
+	}
+
+	posted, err := postStatus(client, reply)
+	if err != nil {
+		if !errors.Is(err, errParentDeleted) {
+			replyWithError(client, notification, fmt.Sprintf("Error posting reply: %v", err))
+		}
+		return nil
+	}
+
+	mirrorReply(client, notification, posted)
+	return posted
+}
+
+var pollOptions = []string{"Crunch it harder", "Go gentler", "It's perfect"}
+
+const defaultPollDuration = 24 * time.Hour
+
+// postPoll follows up a reply with a poll asking whether the crunch should go
+// harder or gentler. Mastodon doesn't allow media and a poll on the same
+// post, so the poll is threaded under the image.
+func postPoll(client *mastodon.Client, notification *mastodon.Notification, posted *mastodon.Status) {
+	duration := config.Bot.PollDuration
+	if duration <= 0 {
+		duration = defaultPollDuration
+	}
+
+	poll := &mastodon.Toot{
+		Status:      newReplyText(notification, "How was that crunch?").String(),
+		InReplyToID: posted.ID,
+		Visibility:  posted.Visibility,
+		Language:    replyLanguage(notification),
+		Poll: &mastodon.TootPoll{
+			Options:          pollOptions,
+			ExpiresInSeconds: int64(duration.Seconds()),
+		},
+	}
+	if _, err := postStatus(client, poll); err != nil {
+		log.Printf("Error posting poll: %v", err)
+	}
+}
+
+// mirrorReply sends a link to a reply we just posted to the configured
+// logging account, so operators can review what the bot is posting. Failures
+// are only logged since the actual reply already went out.
+func mirrorReply(client *mastodon.Client, notification *mastodon.Notification, posted *mastodon.Status) {
+	if config.Bot.MirrorAccount == "" {
+		return
+	}
+
+	mirror := &mastodon.Toot{
+		Status:     fmt.Sprintf("@%s Replied to @%s: %s", strings.TrimPrefix(config.Bot.MirrorAccount, "@"), notification.Account.Acct, posted.URL),
+		Visibility: mastodon.VisibilityDirectMessage,
+	}
+	if _, err := postStatus(client, mirror); err != nil {
+		log.Printf("Error mirroring reply to %s: %v", config.Bot.MirrorAccount, err)
+	}
+}
+
+func replyWithError(client *mastodon.Client, notification *mastodon.Notification, errorMsg string) {
+	replyWithMessage(client, notification, "Oops! "+errorMsg)
+}
+
+// replyVisibility is the visibility of replies to a mention with visibility:
+// the same, except that public mentions get unlisted replies so the bot
+// doesn't flood the public timelines.
+func replyVisibility(visibility string) string {
+	if visibility == mastodon.VisibilityPublic {
+		return mastodon.VisibilityUnlisted
+	}
+	return visibility
+}
+
+// startInterimMessage arranges for a "still working" message to go out if the
+// returned stop func hasn't been called within still_working_after.
+func startInterimMessage(client *mastodon.Client, notification *mastodon.Notification) (stop func()) {
+	delay := config.Reply.StillWorkingAfter
+	if delay <= 0 {
+		return func() {}
+	}
+
+	timer := time.AfterFunc(delay, func() {
+		visibility := replyVisibility(notification.Status.Visibility)
+		if config.Reply.StillWorkingDM {
+			visibility = "direct"
+		}
+		reply := &mastodon.Toot{
+			Status:      newReplyText(notification, "Still crunching, hang tight!").String(),
+			InReplyToID: notification.Status.ID,
+			Visibility:  visibility,
+			Language:    replyLanguage(notification),
+		}
+		if _, err := postStatus(client, reply); err != nil {
+			log.Printf("Error posting interim message: %v", err)
+		}
+	})
+	return func() { timer.Stop() }
+}
+
+// replyWithMessage sends a text-only reply.
+func replyWithMessage(client *mastodon.Client, notification *mastodon.Notification, message string) {
+	reply := &mastodon.Toot{
+		Status:      newReplyText(notification, message).String(),
+		InReplyToID: notification.Status.ID,
+		Visibility:  notification.Status.Visibility,
+		Language:    replyLanguage(notification),
+	}
+
+	_, err := postStatus(client, reply)
+	if err != nil {
+		log.Printf("Error posting reply: %v", err)
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+func TestTruncateStrategies(t *testing.T) {
+	r := replyText{
+		Mention: "@alice",
+		CCs:     []string{"@bob", "@carol"},
+		Body:    "Here's your compressed JPEG!",
+		Footer:  "#jpegbot",
+	}
+
+	tests := []struct {
+		strategy string
+		want     string
+	}{
+		// 56 characters in all, cut to 40 with an ellipsis.
+		{"ellipsis", "@alice @bob @carol Here's your compress…"},
+		{"drop_footer", "@alice @bob @carol Here's your compress…"},
+		{"drop_ccs", "@alice Here's your compressed JPEG! #jp…"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.Reply.MaxLength = 40
+				c.Reply.TruncateStrategy = tt.strategy
+			})
+			got := r.String()
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if length(got) > 40 {
+				t.Errorf("%q is %d characters, over the limit", got, length(got))
+			}
+		})
+	}
+}
+
+func TestDropFooterFitsWithoutCutting(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.Reply.MaxLength = 40
+		c.Reply.TruncateStrategy = "drop_footer"
+	})
+	r := replyText{Mention: "@alice", Body: "Here's your compressed JPEG!", Footer: "#jpegbot #crunch"}
+	if got, want := r.String(), "@alice Here's your compressed JPEG!"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTruncateCountsCharacters(t *testing.T) {
+	s := strings.Repeat("é", 10)
+	if got := truncate(s, 5); got != "éééé…" {
+		t.Errorf("got %q, want four characters and an ellipsis", got)
+	}
+	if got := truncate(s, 10); got != s {
+		t.Errorf("got %q, want it untouched", got)
+	}
+}
+
+func TestMirrorReply(t *testing.T) {
+	f, client := newFakeInstance(t)
+	notification := mention("1", "alice", "<p>@bot</p>")
+	posted := &mastodon.Status{ID: "2", URL: "https://example.com/@bot/2"}
+
+	withConfig(t, func(c *Config) { c.Bot.MirrorAccount = "" })
+	mirrorReply(client, notification, posted)
+	if posts := f.posted(); len(posts) != 0 {
+		t.Fatalf("mirrored a reply with no mirror account configured: %v", posts)
+	}
+
+	withConfig(t, func(c *Config) { c.Bot.MirrorAccount = "@mod@example.com" })
+	mirrorReply(client, notification, posted)
+	posts := f.posted()
+	if len(posts) != 1 {
+		t.Fatalf("posted %d statuses, want one mirror DM", len(posts))
+	}
+	if got, want := posts[0].Get("status"), "@mod@example.com Replied to @alice: https://example.com/@bot/2"; got != want {
+		t.Errorf("mirror DM is %q, want %q", got, want)
+	}
+	if got := posts[0].Get("visibility"); got != mastodon.VisibilityDirectMessage {
+		t.Errorf("mirror DM has visibility %q", got)
+	}
+}
+
+func TestPostStatusEmptyResponse(t *testing.T) {
+	f, client := newFakeInstance(t)
+	registry := withMetrics(t)
+	f.handle(http.MethodPost, "/api/v1/statuses", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{})
+	})
+
+	status, err := postStatus(client, &mastodon.Toot{Status: "hello"})
+	if !errors.Is(err, errEmptyStatus) {
+		t.Errorf("got %v, %v; want errEmptyStatus", status, err)
+	}
+	if registry.counters["jpegbot_post_failures_total"] != 1 {
+		t.Error("empty status wasn't counted as a failed post")
+	}
+}
+
+func TestPostPoll(t *testing.T) {
+	f, client := newFakeInstance(t)
+	withConfig(t, func(c *Config) { c.Bot.PollDuration = 2 * time.Hour })
+
+	postPoll(client, mention("1", "alice", "<p>@bot poll</p>"), &mastodon.Status{ID: "77", Visibility: "unlisted"})
+
+	posts := f.posted()
+	if len(posts) != 1 {
+		t.Fatalf("posted %d statuses, want one poll", len(posts))
+	}
+	poll := posts[0]
+	if got := poll["poll[options][]"]; !reflect.DeepEqual(got, pollOptions) {
+		t.Errorf("poll options are %v, want %v", got, pollOptions)
+	}
+	if got := poll.Get("poll[expires_in]"); got != "7200" {
+		t.Errorf("poll expires in %s seconds, want 7200", got)
+	}
+	if got := poll.Get("in_reply_to_id"); got != "77" {
+		t.Errorf("poll replies to %q, want the image reply", got)
+	}
+	if len(poll["media_ids[]"]) != 0 {
+		t.Error("poll has media attached")
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := map[time.Duration]string{
+		320 * time.Millisecond:  "320ms",
+		999 * time.Millisecond:  "999ms",
+		1400 * time.Millisecond: "1.4s",
+		12 * time.Second:        "12.0s",
+	}
+	for d, want := range tests {
+		if got := formatDuration(d); got != want {
+			t.Errorf("formatDuration(%v) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+// jpegResult is a small crunched image ready for uploading.
+func jpegResult(t *testing.T) result {
+	t.Helper()
+	return result{Data: encodeJPEGData(t, testImage(16, 16), 5), Format: "jpeg"}
+}
+
+func TestReplyTiming(t *testing.T) {
+	timing := regexp.MustCompile(`\(took \d+ms\)$`)
+	for _, show := range []bool{false, true} {
+		f, client := newFakeInstance(t)
+		withConfig(t, func(c *Config) { c.Reply.ShowTiming = show })
+
+		res := jpegResult(t)
+		res.Elapsed = 250 * time.Millisecond
+		uploadMediaAndReply(client, batch{results: []result{res}}, mention("1", "alice", "<p>@bot</p>"), "public")
+
+		posts := f.posted()
+		if len(posts) != 1 {
+			t.Fatalf("posted %d statuses, want 1", len(posts))
+		}
+		if got := timing.MatchString(posts[0].Get("status")); got != show {
+			t.Errorf("with show_timing %v, reply %q has timing: %v", show, posts[0].Get("status"), got)
+		}
+	}
+}
+
+func TestReplyToDeletedParent(t *testing.T) {
+	tests := []struct {
+		setting string
+		wantErr error
+		posts   int
+	}{
+		{"standalone", nil, 1},
+		{"drop", errParentDeleted, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.setting, func(t *testing.T) {
+			f, client := newFakeInstance(t)
+			withConfig(t, func(c *Config) { c.Reply.OnDeletedParent = tt.setting })
+
+			var posted []string
+			f.handle(http.MethodPost, "/api/v1/statuses", func(w http.ResponseWriter, r *http.Request) {
+				if r.FormValue("in_reply_to_id") != "" {
+					http.Error(w, `{"error":"Record not found"}`, http.StatusNotFound)
+					return
+				}
+				posted = append(posted, r.FormValue("status"))
+				writeJSON(w, mastodon.Status{ID: "2"})
+			})
+
+			status, err := postStatus(client, &mastodon.Toot{Status: "@alice here", InReplyToID: "1"})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if len(posted) != tt.posts {
+				t.Fatalf("posted %v, want %d standalone posts", posted, tt.posts)
+			}
+			if tt.posts > 0 && (status == nil || posted[0] != "@alice here") {
+				t.Errorf("standalone post is %v, %q", status, posted)
+			}
+		})
+	}
+}
+
+func TestInterimMessage(t *testing.T) {
+	f, client := newFakeInstance(t)
+	withConfig(t, func(c *Config) { c.Reply.StillWorkingAfter = 30 * time.Millisecond })
+	notification := mention("1", "alice", "<p>@bot</p>")
+
+	// Done in time: nothing is sent.
+	stop := startInterimMessage(client, notification)
+	stop()
+	time.Sleep(60 * time.Millisecond)
+	if posts := f.posted(); len(posts) != 0 {
+		t.Fatalf("interim message sent for a quick job: %v", posts)
+	}
+
+	// Too slow: the message goes out once, as a DM if configured.
+	withConfig(t, func(c *Config) { c.Reply.StillWorkingDM = true })
+	stop = startInterimMessage(client, notification)
+	waitFor(t, "the interim message", func() bool { return len(f.posted()) > 0 })
+	stop()
+
+	post := f.posted()[0]
+	if !strings.Contains(post.Get("status"), "Still crunching") {
+		t.Errorf("interim message is %q", post.Get("status"))
+	}
+	if post.Get("visibility") != "direct" || post.Get("in_reply_to_id") != "1" {
+		t.Errorf("interim message went out as %q in reply to %q", post.Get("visibility"), post.Get("in_reply_to_id"))
+	}
+
+	// Otherwise it goes out like the final reply would: unlisted for a
+	// public mention, and private or direct ones keep theirs.
+	withConfig(t, func(c *Config) { c.Reply.StillWorkingDM = false })
+	for i, tt := range []struct{ mention, want string }{
+		{"public", "unlisted"},
+		{"unlisted", "unlisted"},
+		{"private", "private"},
+		{"direct", "direct"},
+	} {
+		n := mention(fmt.Sprint(i+2), "alice", "<p>@bot</p>")
+		n.Status.Visibility = tt.mention
+		before := len(f.posted())
+		stop = startInterimMessage(client, n)
+		waitFor(t, "the interim message", func() bool { return len(f.posted()) > before })
+		stop()
+		if got := f.posted()[before].Get("visibility"); got != tt.want {
+			t.Errorf("interim message for a %s mention is %q, want %q", tt.mention, got, tt.want)
+		}
+	}
+}
+
+func TestInterimMessageDisabled(t *testing.T) {
+	f, client := newFakeInstance(t)
+	withConfig(t, func(c *Config) { c.Reply.StillWorkingAfter = 0 })
+
+	stop := startInterimMessage(client, mention("1", "alice", "<p>@bot</p>"))
+	time.Sleep(20 * time.Millisecond)
+	stop()
+	if posts := f.posted(); len(posts) != 0 {
+		t.Errorf("interim message sent with still_working_after off: %v", posts)
+	}
+}
+
+func TestSignedReplies(t *testing.T) {
+	notification := mention("1", "alice", "<p>@bot</p>")
+	tag := jobTag(notification)
+	if tag != jobTag(mention("1", "alice", "<p>@bot</p>")) {
+		t.Fatal("the same job got different tags")
+	}
+	if tag == jobTag(mention("2", "alice", "<p>@bot</p>")) {
+		t.Fatal("different jobs got the same tag")
+	}
+	if len(tag) != 6 {
+		t.Errorf("tag %q isn't 6 characters", tag)
+	}
+
+	withConfig(t, func(c *Config) { c.Reply.Sign = false })
+	if got := newReplyText(notification, "Done!").String(); strings.Contains(got, tag) {
+		t.Errorf("unsigned reply %q has the tag", got)
+	}
+
+	withConfig(t, func(c *Config) {
+		c.Reply.Sign = true
+		c.Reply.MaxLength = 30
+	})
+	got := newReplyText(notification, "Here's your compressed JPEG!").String()
+	if !strings.HasSuffix(got, " ["+tag+"]") || length(got) > 30 {
+		t.Errorf("signed reply %q doesn't end with the tag within the limit", got)
+	}
+
+	// Limits too small for anything but the tag don't trip up truncation.
+	for limit := 1; limit <= 10; limit++ {
+		withConfig(t, func(c *Config) { c.Reply.MaxLength = limit })
+		if got := newReplyText(notification, "Done!").String(); !strings.Contains(got, tag) {
+			t.Errorf("limit %d: reply %q lost the tag", limit, got)
+		}
+	}
+}
+
+func TestReplyLanguage(t *testing.T) {
+	f, client := newFakeInstance(t)
+
+	for i, tt := range []struct {
+		source, fallback string
+		ignore           bool
+		want             string
+	}{
+		{"de", "", false, "de"},
+		{"ja", "en", false, "ja"},
+		{"pt-BR", "en", false, "pt-BR"},
+		{"", "en", false, "en"},
+		{"", "", false, ""},
+		{"de", "en", true, "en"},
+	} {
+		withConfig(t, func(c *Config) {
+			c.Reply.Language = tt.fallback
+			c.Reply.IgnoreLanguage = tt.ignore
+		})
+		notification := imageMention(t, f, fmt.Sprint(i+1), "<p>@bot</p>", 1)
+		notification.Status.Language = tt.source
+		handleMention(client, notification)
+
+		posts := f.posted()
+		if got := posts[len(posts)-1].Get("language"); got != tt.want {
+			t.Errorf("reply to a %q mention (default %q, ignore %v) is tagged %q, want %q", tt.source, tt.fallback, tt.ignore, got, tt.want)
+		}
+	}
+}
+
+func TestContentWarnedMention(t *testing.T) {
+	f, client := newFakeInstance(t)
+
+	// A CW that's just a description isn't mistaken for commands.
+	notification := imageMention(t, f, "1", "<p>@bot</p>", 1)
+	notification.Status.SpoilerText = "low quality pic"
+	notification.Status.Sensitive = true
+	handleMention(client, notification)
+
+	posts := f.posted()
+	if len(posts) != 1 || len(posts[0]["media_ids[]"]) != 1 {
+		t.Fatalf("replied %v, want one reply with the crunched image", posts)
+	}
+	if got := posts[0].Get("spoiler_text"); got != "low quality pic" {
+		t.Errorf("reply has content warning %q, want the mention's", got)
+	}
+	if posts[0].Get("sensitive") != "true" {
+		t.Error("reply media isn't marked sensitive")
+	}
+
+	// Commands in the CW are used when the mention has none of its own.
+	opts, err := parseMentionOptions("<p>@bot</p>", "quality 20")
+	if err != nil || opts.Quality != 20 {
+		t.Errorf("commands in the CW parsed as %+v, %v", opts, err)
+	}
+	if opts, err := parseMentionOptions("<p>@bot quality 30</p>", "quality 20"); err != nil || opts.Quality != 30 {
+		t.Errorf("the mention's own commands gave %+v, %v; want them to win over the CW", opts, err)
+	}
+
+	// An uncovered mention of a CW'd post gets its CW.
+	f.addStatus(&mastodon.Status{
+		ID:               "10",
+		SpoilerText:      "eye strain",
+		MediaAttachments: []mastodon.Attachment{{Type: "image", URL: f.serveFile("/media/cw.png", "image/png", encodePNG(t, testImage(16, 16)))}},
+	})
+	notification = mention("2", "alice", "<p>@bot</p>")
+	notification.Status.InReplyToID = "10"
+	handleMention(client, notification)
+	posts = f.posted()
+	if got := posts[len(posts)-1].Get("spoiler_text"); got != "eye strain" {
+		t.Errorf("reply to a mention of a CW'd post has content warning %q, want the post's", got)
+	}
+
+	withConfig(t, func(c *Config) { c.Reply.IgnoreCW = true })
+	notification = imageMention(t, f, "3", "<p>@bot</p>", 1)
+	notification.Status.SpoilerText = "low quality pic"
+	handleMention(client, notification)
+	posts = f.posted()
+	if last := posts[len(posts)-1]; last.Get("spoiler_text") != "" || last.Get("sensitive") != "" {
+		t.Errorf("with ignore_cw the reply still has content warning %q", last.Get("spoiler_text"))
+	}
+}
+
+func TestPartialUpload(t *testing.T) {
+	f, client := newFakeInstance(t)
+
+	// The second upload fails outright and the third comes back without an
+	// ID, out of every three.
+	uploads := 0
+	f.handle(http.MethodPost, "/api/v1/media", func(w http.ResponseWriter, r *http.Request) {
+		uploads++
+		switch uploads % 3 {
+		case 2:
+			http.Error(w, `{"error":"storage is full"}`, http.StatusInternalServerError)
+		case 0:
+			writeJSON(w, mastodon.Attachment{Type: "image"})
+		default:
+			writeJSON(w, mastodon.Attachment{ID: mastodon.ID(fmt.Sprint("m", uploads)), Type: "image"})
+		}
+	})
+
+	withConfig(t, func(c *Config) { c.Reply.OnPartialUpload = "post" })
+	handleMention(client, imageMention(t, f, "1", "<p>@bot</p>", 3))
+	posts := f.posted()
+	if len(posts) != 1 {
+		t.Fatalf("posted %d replies, want 1", len(posts))
+	}
+	if got := posts[0]["media_ids[]"]; !reflect.DeepEqual(got, []string{"m1"}) {
+		t.Errorf("reply has media %q, want just the one that uploaded", got)
+	}
+	status := posts[0].Get("status")
+	if !strings.Contains(status, "2 of the images didn't make it") || !strings.Contains(status, "didn't return a media ID") {
+		t.Errorf("reply %q doesn't explain the failed uploads", status)
+	}
+
+	withConfig(t, func(c *Config) { c.Reply.OnPartialUpload = "fail" })
+	handleMention(client, imageMention(t, f, "2", "<p>@bot</p>", 3))
+	posts = f.posted()
+	if len(posts) != 2 {
+		t.Fatalf("posted %d replies, want 2", len(posts))
+	}
+	if got := posts[1]["media_ids[]"]; len(got) != 0 {
+		t.Errorf("fail still posted media %q", got)
+	}
+	if !strings.Contains(posts[1].Get("status"), "Error uploading media") {
+		t.Errorf("reply %q doesn't give the upload errors", posts[1].Get("status"))
+	}
+}
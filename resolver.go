@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// imageSources are the places in a status an image can come from, in order
+// of precedence. The first source that finds anything wins.
+var imageSources = []func(status *mastodon.Status) []string{
+	attachmentImages,
+	cardImages,
+	linkImages,
+}
+
+// maxThreadDepth is how far up a linked post's thread to look for an image.
+const maxThreadDepth = 5
+
+// resolveImages finds the images a mention is about, along with the status
+// they're in: anything in the status itself, then anything in the post it
+// replies to, and failing that, anything in or above a post it links to.
+//
+// Boosts can't be replied to, so the way to point the bot at one is to link
+// it. The link resolves to the boosted post, whose thread is then searched
+// for an image further up.
+func resolveImages(client *mastodon.Client, status *mastodon.Status) ([]string, *mastodon.Status) {
+	if images := imagesInStatus(status); len(images) > 0 {
+		return images, status
+	}
+	if parent := fetchParent(client, status); parent != nil {
+		if images := imagesInStatus(parent); len(images) > 0 {
+			return images, parent
+		}
+	}
+
+	if linked := linkedStatus(client, status); linked != nil {
+		if images, source := threadImages(client, linked); len(images) > 0 {
+			return images, source
+		}
+	}
+	return nil, nil
+}
+
+var (
+	anchorPattern = regexp.MustCompile(`<a\s[^>]*>`)
+	classPattern  = regexp.MustCompile(`class="([^"]*)"`)
+
+	// statusPathPattern matches the paths fediverse software puts posts
+	// at: Mastodon's /@user/<id> and /users/<user>/statuses/<id>, and the
+	// /notice/, /notes/ and /objects/ forms used elsewhere.
+	statusPathPattern = regexp.MustCompile(`^/(@[^/]+|users/[^/]+/statuses|notice|notes|objects)/[A-Za-z0-9-]+/?$`)
+)
+
+// linkedStatus returns the post behind the first link in status that looks
+// like a post, or nil. Mentions and hashtags are links too, but are marked as
+// such and skipped.
+func linkedStatus(client *mastodon.Client, status *mastodon.Status) *mastodon.Status {
+	for _, anchor := range anchorPattern.FindAllString(status.Content, -1) {
+		if class := classPattern.FindStringSubmatch(anchor); class != nil && strings.Contains(class[1], "mention") {
+			continue
+		}
+		href := hrefPattern.FindStringSubmatch(anchor)
+		if href == nil {
+			continue
+		}
+		link := html.UnescapeString(href[1])
+		u, err := url.Parse(link)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+		if !statusPathPattern.MatchString(u.Path) {
+			continue
+		}
+
+		// Only the first candidate is looked up, since resolving makes the
+		// instance fetch it from wherever it lives.
+		results, err := client.Search(ctx, link, true)
+		if err != nil {
+			log.Printf("Error resolving linked post %s: %v", link, err)
+			return nil
+		}
+		if len(results.Statuses) == 0 {
+			return nil
+		}
+		return results.Statuses[0]
+	}
+	return nil
+}
+
+// threadImages returns the images in status or, failing that, the nearest
+// post above it in its reply chain that has some, along with that post.
+func threadImages(client *mastodon.Client, status *mastodon.Status) ([]string, *mastodon.Status) {
+	for depth := 0; status != nil && depth <= maxThreadDepth; depth++ {
+		if images := imagesInStatus(status); len(images) > 0 {
+			return images, status
+		}
+		status = fetchParent(client, status)
+	}
+	return nil, nil
+}
+
+func imagesInStatus(status *mastodon.Status) []string {
+	for _, source := range imageSources {
+		if images := source(status); len(images) > 0 {
+			return images
+		}
+	}
+	return nil
+}
+
+func attachmentImages(status *mastodon.Status) []string {
+	var images []string
+	for _, attachment := range status.MediaAttachments {
+		if attachment.Type == "image" {
+			images = append(images, attachment.URL)
+		}
+	}
+	return images
+}
+
+// cardImages handles posts that are just a link, which the instance turns
+// into a preview card without any attachment.
+func cardImages(status *mastodon.Status) []string {
+	card := status.Card
+	if card == nil {
+		return nil
+	}
+	if card.Type == "photo" && card.URL != "" {
+		return []string{card.URL}
+	}
+	if card.Image != "" {
+		return []string{card.Image}
+	}
+	return nil
+}
+
+var hrefPattern = regexp.MustCompile(`href="([^"]+)"`)
+
+var imageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+}
+
+// linkImages picks out links in the status text that point straight at an
+// image file.
+func linkImages(status *mastodon.Status) []string {
+	var images []string
+	for _, match := range hrefPattern.FindAllStringSubmatch(status.Content, -1) {
+		link := html.UnescapeString(match[1])
+		u, err := url.Parse(link)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+		if imageExtensions[strings.ToLower(path.Ext(u.Path))] {
+			images = append(images, link)
+		}
+	}
+	return images
+}
+
+// fetchParent returns the status this one replies to, or nil if there isn't
+// one or it can't be fetched.
+func fetchParent(client *mastodon.Client, status *mastodon.Status) *mastodon.Status {
+	var parentID mastodon.ID
+
+	switch id := status.InReplyToID.(type) {
+	case nil:
+		return nil
+	case string:
+		parentID = mastodon.ID(id)
+	case mastodon.ID:
+		parentID = id
+	default:
+		log.Printf("Unexpected type for InReplyToID: %T", status.InReplyToID)
+		return nil
+	}
+	if parentID == "" {
+		return nil
+	}
+
+	parent, err := client.GetStatus(ctx, parentID)
+	if err != nil {
+		log.Printf("Error fetching parent status %s: %v", parentID, err)
+		return nil
+	}
+	return parent
+}
+
+// resolveAvatar finds the avatar an "avatar" mention is about: that of the
+// first account mentioned other than the bot, or the requester's own.
+func resolveAvatar(client *mastodon.Client, notification *mastodon.Notification) (string, error) {
+	account := &notification.Account
+
+	for _, mention := range notification.Status.Mentions {
+		if mention.ID == selfID {
+			continue
+		}
+		target, err := client.GetAccount(ctx, mention.ID)
+		if err != nil {
+			log.Printf("Error fetching account %s: %v", mention.Acct, err)
+			return "", fmt.Errorf("I couldn't find @%s", mention.Acct)
+		}
+		account = target
+		break
+	}
+
+	// Accounts without an avatar get the instance's placeholder image.
+	if account.Avatar == "" || strings.HasSuffix(account.Avatar, "/missing.png") {
+		return "", fmt.Errorf("@%s doesn't have an avatar", account.Acct)
+	}
+	return account.Avatar, nil
+}
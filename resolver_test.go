@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mattn/go-mastodon"
+)
+
+func TestImageSourcePrecedence(t *testing.T) {
+	attachment := []mastodon.Attachment{{Type: "image", URL: "https://cdn.example.com/attached.png"}}
+	card := &mastodon.Card{Type: "link", Image: "https://cdn.example.com/card.jpg"}
+	link := `<p>look <a href="https://cdn.example.com/linked.webp">here</a></p>`
+
+	tests := []struct {
+		name   string
+		status *mastodon.Status
+		want   []string
+	}{
+		{
+			name:   "attachment beats everything",
+			status: &mastodon.Status{MediaAttachments: attachment, Card: card, Content: link},
+			want:   []string{"https://cdn.example.com/attached.png"},
+		},
+		{
+			name:   "card beats link",
+			status: &mastodon.Status{Card: card, Content: link},
+			want:   []string{"https://cdn.example.com/card.jpg"},
+		},
+		{
+			name:   "photo card uses its URL",
+			status: &mastodon.Status{Card: &mastodon.Card{Type: "photo", URL: "https://cdn.example.com/photo.jpg", Image: "https://cdn.example.com/thumb.jpg"}},
+			want:   []string{"https://cdn.example.com/photo.jpg"},
+		},
+		{
+			name:   "direct image link",
+			status: &mastodon.Status{Content: link},
+			want:   []string{"https://cdn.example.com/linked.webp"},
+		},
+		{
+			name:   "videos and page links aren't images",
+			status: &mastodon.Status{MediaAttachments: []mastodon.Attachment{{Type: "video", URL: "https://cdn.example.com/clip.mp4"}}, Content: `<a href="https://example.com/page">page</a>`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := imagesInStatus(tt.status); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("found %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveImagesFromParent(t *testing.T) {
+	f, client := newFakeInstance(t)
+	parent := &mastodon.Status{
+		ID:               "1",
+		MediaAttachments: []mastodon.Attachment{{Type: "image", URL: "https://cdn.example.com/parent.png"}},
+	}
+	f.addStatus(parent)
+
+	status := &mastodon.Status{ID: "2", InReplyToID: "1", Content: "<p>@bot crunch this</p>"}
+	images, source := resolveImages(client, status)
+	if !reflect.DeepEqual(images, []string{"https://cdn.example.com/parent.png"}) {
+		t.Errorf("found %v, want the parent's image", images)
+	}
+	if source == nil || source.ID != "1" {
+		t.Errorf("source is %v, want the parent", source)
+	}
+
+	// The mention's own image wins over the parent's.
+	status.MediaAttachments = []mastodon.Attachment{{Type: "image", URL: "https://cdn.example.com/own.png"}}
+	if images, _ := resolveImages(client, status); !reflect.DeepEqual(images, []string{"https://cdn.example.com/own.png"}) {
+		t.Errorf("found %v, want the mention's own image", images)
+	}
+}
+
+func TestResolveAvatar(t *testing.T) {
+	f, client := newFakeInstance(t)
+	savedSelf := selfID
+	t.Cleanup(func() { selfID = savedSelf })
+	selfID = "bot"
+
+	f.handle(http.MethodGet, "/api/v1/accounts/target", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, mastodon.Account{ID: "target", Acct: "target@example.com", Avatar: "https://cdn.example.com/target.png"})
+	})
+	f.handle(http.MethodGet, "/api/v1/accounts/blank", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, mastodon.Account{ID: "blank", Acct: "blank", Avatar: "https://example.com/avatars/original/missing.png"})
+	})
+
+	notification := mention("1", "alice", "<p>@bot avatar @target</p>")
+	notification.Account.Avatar = "https://cdn.example.com/alice.png"
+	notification.Status.Mentions = []mastodon.Mention{
+		{ID: "bot", Acct: "bot"},
+		{ID: "target", Acct: "target@example.com"},
+	}
+	if got, err := resolveAvatar(client, notification); err != nil || got != "https://cdn.example.com/target.png" {
+		t.Errorf("got %q, %v; want the mentioned account's avatar", got, err)
+	}
+
+	notification.Status.Mentions = notification.Status.Mentions[:1]
+	if got, err := resolveAvatar(client, notification); err != nil || got != "https://cdn.example.com/alice.png" {
+		t.Errorf("got %q, %v; want the requester's own avatar", got, err)
+	}
+
+	notification.Status.Mentions = []mastodon.Mention{{ID: "blank", Acct: "blank"}}
+	if _, err := resolveAvatar(client, notification); err == nil || !strings.Contains(err.Error(), "doesn't have an avatar") {
+		t.Errorf("placeholder avatar gave %v", err)
+	}
+
+	notification.Status.Mentions = []mastodon.Mention{{ID: "gone", Acct: "gone"}}
+	if _, err := resolveAvatar(client, notification); err == nil || !strings.Contains(err.Error(), "couldn't find @gone") {
+		t.Errorf("unknown account gave %v", err)
+	}
+}
+
+func TestResolveLinkedBoostThread(t *testing.T) {
+	f, client := newFakeInstance(t)
+
+	// The boosted post is a reply to the one with the image.
+	f.addStatus(&mastodon.Status{
+		ID:               "upstream",
+		MediaAttachments: []mastodon.Attachment{{Type: "image", URL: "https://cdn.example.com/upstream.png"}},
+	})
+	boosted := &mastodon.Status{ID: "boosted", InReplyToID: "upstream", Content: "<p>look at this</p>"}
+
+	var queries []string
+	f.handle(http.MethodGet, "/api/v2/search", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("resolve") != "true" {
+			t.Errorf("searched without resolving")
+		}
+		queries = append(queries, r.URL.Query().Get("q"))
+		writeJSON(w, mastodon.Results{Statuses: []*mastodon.Status{boosted}})
+	})
+
+	status := &mastodon.Status{
+		ID: "mention",
+		Content: `<p><span class="h-card"><a href="https://example.com/@bot" class="u-url mention">@bot</a></span> ` +
+			`<a href="https://example.com/tags/jpeg" class="mention hashtag" rel="tag">#jpeg</a> ` +
+			`<a href="https://other.example/@carol/42" rel="nofollow noopener">other.example/@carol/42</a></p>`,
+	}
+	images, source := resolveImages(client, status)
+	if !reflect.DeepEqual(images, []string{"https://cdn.example.com/upstream.png"}) {
+		t.Errorf("found %v, want the image above the boosted post", images)
+	}
+	if source == nil || source.ID != "upstream" {
+		t.Errorf("source is %v, want the upstream post", source)
+	}
+	if !reflect.DeepEqual(queries, []string{"https://other.example/@carol/42"}) {
+		t.Errorf("looked up %q, want only the post link", queries)
+	}
+}
+
+func TestLinkedStatusIsALastResort(t *testing.T) {
+	f, client := newFakeInstance(t)
+	f.addStatus(&mastodon.Status{
+		ID:               "1",
+		MediaAttachments: []mastodon.Attachment{{Type: "image", URL: "https://cdn.example.com/parent.png"}},
+	})
+
+	var queries []string
+	f.handle(http.MethodGet, "/api/v2/search", func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query().Get("q"))
+		writeJSON(w, mastodon.Results{})
+	})
+
+	// A reply with an image above it never looks the link up.
+	status := &mastodon.Status{ID: "2", InReplyToID: "1", Content: `<p><a href="https://other.example/@carol/42">post</a></p>`}
+	if images, _ := resolveImages(client, status); !reflect.DeepEqual(images, []string{"https://cdn.example.com/parent.png"}) {
+		t.Errorf("found %v, want the parent's image", images)
+	}
+	if len(queries) != 0 {
+		t.Errorf("looked up %q despite the parent having an image", queries)
+	}
+
+	// Links that aren't to posts are never looked up either.
+	status = &mastodon.Status{ID: "3", Content: `<p><a href="https://example.com/blog/2024/hello">blog</a> ` +
+		`<a href="https://other.example/users/carol/statuses/42">post</a></p>`}
+	resolveImages(client, status)
+	if !reflect.DeepEqual(queries, []string{"https://other.example/users/carol/statuses/42"}) {
+		t.Errorf("looked up %q, want only the post link", queries)
+	}
+}
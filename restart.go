@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"math/rand"
+)
+
+const (
+	maxRestartRows = 64
+	maxBitFlips    = 200
+
+	// The standard library encodes colour images with 4:2:0 subsampling, so
+	// an MCU is 16 pixels square.
+	mcuSize = 16
+
+	// How many tries each requested bit flip gets to find one the decoder
+	// survives.
+	bitFlipAttempts = 5
+)
+
+const (
+	markerSOF0 = 0xc0
+	markerRST0 = 0xd0
+	markerEOI  = 0xd9
+	markerSOS  = 0xda
+	markerDRI  = 0xdd
+)
+
+// encoder picks the JPEG encoder the mention asked for.
+func (o options) encoder() jpegEncoder {
+	if o.RestartRows == 0 {
+		return encodeJPEG
+	}
+	return func(img image.Image, quality int) ([]byte, error) {
+		return encodeRestartJPEG(img, quality, o.RestartRows, o.BitFlips, o.Seed)
+	}
+}
+
+// encodeRestartJPEG encodes img with a restart marker every rows rows of
+// MCUs, then flips up to flips bits of the entropy-coded data. The markers
+// stop damage from spreading past the next one, which gives corrupted JPEGs
+// their streaky look.
+//
+// The standard library's encoder doesn't do restart intervals, but an
+// interval covering whole MCU rows is just independently encoded strips, so
+// each strip is encoded by itself and the scans are stitched together.
+func encodeRestartJPEG(img image.Image, quality, rows, flips int, seed int64) ([]byte, error) {
+	src := toRGBA(img)
+	b := src.Bounds()
+	stripHeight := rows * mcuSize
+
+	mcusPerRow := (b.Dx() + mcuSize - 1) / mcuSize
+	interval := mcusPerRow * rows
+	if interval > 0xffff {
+		return nil, fmt.Errorf("the image is too wide for a %d row restart interval", rows)
+	}
+
+	var strips [][]byte
+	for y := 0; y < b.Dy(); y += stripHeight {
+		strip := src.SubImage(image.Rect(0, y, b.Dx(), min(y+stripHeight, b.Dy())))
+		data, err := encodeJPEG(strip, quality)
+		if err != nil {
+			return nil, err
+		}
+		strips = append(strips, data)
+	}
+	if len(strips) == 0 {
+		return nil, fmt.Errorf("the image is empty")
+	}
+
+	clean, err := stitchStrips(strips, b.Dy(), interval)
+	if err != nil || flips == 0 {
+		return clean, err
+	}
+
+	corruptStrips(strips, flips, rand.New(rand.NewSource(seed)))
+	corrupted, err := stitchStrips(strips, b.Dy(), interval)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := decodeImage(corrupted); err != nil {
+		return clean, nil
+	}
+	return corrupted, nil
+}
+
+// stitchStrips joins separately encoded strips into one JPEG of the given
+// height, with a restart marker between strips.
+func stitchStrips(strips [][]byte, height, interval int) ([]byte, error) {
+	var out bytes.Buffer
+	for i, strip := range strips {
+		header, scan, err := splitScan(strip)
+		if err != nil {
+			return nil, err
+		}
+
+		if i == 0 {
+			sos := bytes.LastIndex(header, []byte{0xff, markerSOS})
+			tables := append([]byte(nil), header[:sos]...)
+			if err := setHeight(tables, height); err != nil {
+				return nil, err
+			}
+			out.Write(tables)
+			out.Write([]byte{0xff, markerDRI, 0, 4, byte(interval >> 8), byte(interval)})
+			out.Write(header[sos:])
+		} else {
+			out.Write([]byte{0xff, byte(markerRST0 + (i-1)%8)})
+		}
+		out.Write(scan)
+	}
+	out.Write([]byte{0xff, markerEOI})
+	return out.Bytes(), nil
+}
+
+// splitScan splits an encoded baseline JPEG into everything up to and
+// including the SOS segment, and the entropy-coded scan after it.
+func splitScan(data []byte) (header, scan []byte, err error) {
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return nil, nil, fmt.Errorf("malformed jpeg segment at %d", i)
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if end > len(data) {
+			break
+		}
+		if data[i+1] == markerSOS {
+			return data[:end], data[end : len(data)-2], nil
+		}
+		i = end
+	}
+	return nil, nil, fmt.Errorf("jpeg has no scan")
+}
+
+// setHeight rewrites the image height in the SOF0 segment of a JPEG header.
+func setHeight(header []byte, height int) error {
+	for i := 2; i+4 <= len(header); {
+		length := int(binary.BigEndian.Uint16(header[i+2:]))
+		if header[i+1] == markerSOF0 && i+7 <= len(header) {
+			binary.BigEndian.PutUint16(header[i+5:], uint16(height))
+			return nil
+		}
+		i += 2 + length
+	}
+	return fmt.Errorf("jpeg has no SOF0 segment")
+}
+
+// corruptStrips flips up to n random bits in the strips' entropy-coded data,
+// keeping only flips the strip still decodes with. Bytes that are or follow a
+// 0xFF are left alone, and no flip may produce a 0xFF, so markers are never
+// created or destroyed.
+func corruptStrips(strips [][]byte, n int, rng *rand.Rand) {
+	for attempts, flipped := 0, 0; flipped < n && attempts < n*bitFlipAttempts; attempts++ {
+		strip := strips[rng.Intn(len(strips))]
+		header, scan, err := splitScan(strip)
+		if err != nil || len(scan) == 0 {
+			continue
+		}
+
+		i := len(header) + rng.Intn(len(scan))
+		old := strip[i]
+		b := old ^ 1<<rng.Intn(8)
+		if old == 0xff || strip[i-1] == 0xff || b == 0xff {
+			continue
+		}
+
+		strip[i] = b
+		if _, _, err := decodeImage(strip); err != nil {
+			strip[i] = old
+			continue
+		}
+		flipped++
+	}
+}
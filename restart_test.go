@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+func TestRestartJPEGDecodes(t *testing.T) {
+	img := testImage(70, 48)
+
+	clean, err := encodeRestartJPEG(img, 30, 1, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(clean))
+	if err != nil {
+		t.Fatalf("restart-marked JPEG doesn't decode: %v", err)
+	}
+	if decoded.Bounds().Size() != image.Pt(70, 48) {
+		t.Errorf("decoded as %v, want 70×48", decoded.Bounds().Size())
+	}
+	if !bytes.Contains(clean, []byte{0xff, markerDRI, 0, 4}) {
+		t.Error("no restart interval is defined")
+	}
+	// Three strips of one MCU row are separated by two restart markers.
+	for i := byte(0); i < 2; i++ {
+		if !bytes.Contains(clean, []byte{0xff, markerRST0 + i}) {
+			t.Errorf("RST%d marker is missing", i)
+		}
+	}
+
+	glitched, err := encodeRestartJPEG(img, 30, 1, 20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(glitched, clean) {
+		t.Error("bit flips didn't change anything")
+	}
+	decoded, err = jpeg.Decode(bytes.NewReader(glitched))
+	if err != nil {
+		t.Fatalf("glitched JPEG doesn't decode: %v", err)
+	}
+	if decoded.Bounds().Size() != image.Pt(70, 48) {
+		t.Errorf("glitched JPEG decoded as %v, want 70×48", decoded.Bounds().Size())
+	}
+
+	again, _ := encodeRestartJPEG(img, 30, 1, 20, 1)
+	if !bytes.Equal(glitched, again) {
+		t.Error("the same seed glitched differently")
+	}
+}
+
+func TestRestartCommand(t *testing.T) {
+	opts, err := parseOptions("@bot restart 2 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.RestartRows != 2 || opts.BitFlips != 10 {
+		t.Errorf("parsed as %d rows and %d flips", opts.RestartRows, opts.BitFlips)
+	}
+	for _, bad := range []string{"@bot restart 0", "@bot restart 65", "@bot restart 1 201"} {
+		if _, err := parseOptions(bad); err == nil {
+			t.Errorf("%q parsed without an error", bad)
+		}
+	}
+}
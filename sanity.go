@@ -0,0 +1,51 @@
+package main
+
+import "image"
+
+const defaultUniformMinBytes = 20000
+
+// looksCorrupt reports whether a decode is suspiciously flat for the size of
+// its source, which usually means the file was cut short and the decoder
+// filled in the rest.
+func looksCorrupt(d decodedImage) bool {
+	threshold := config.Image.UniformThreshold
+	if threshold <= 0 {
+		return false
+	}
+	minBytes := config.Image.UniformMinBytes
+	if minBytes <= 0 {
+		minBytes = defaultUniformMinBytes
+	}
+	if d.originalLength < minBytes {
+		return false
+	}
+
+	img := d.img
+	if d.anim != nil {
+		img = d.anim.Frames[0]
+	}
+	return uniformity(img) >= threshold
+}
+
+// uniformity is the fraction of img taken up by its most common colour, with
+// colours quantized to 4 bits per channel. Large images are sampled on a grid.
+func uniformity(img image.Image) float64 {
+	counts := make(map[int]int)
+	total, most := 0, 0
+
+	bounds := img.Bounds()
+	step := sampleStep(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			r, g, b, _ := img.At(x, y).RGBA()
+			key := int(r>>12)<<8 | int(g>>12)<<4 | int(b>>12)
+			counts[key]++
+			most = max(most, counts[key])
+			total++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(most) / float64(total)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"net/http"
+	"testing"
+)
+
+func TestLooksCorrupt(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.Image.UniformThreshold = 0.98
+		c.Image.UniformMinBytes = 100
+	})
+	flat := flatColor(64, 64, color.RGBA{128, 128, 128, 255})
+
+	if !looksCorrupt(decodedImage{img: flat, originalLength: 5000}) {
+		t.Error("flat decode of a large file wasn't flagged")
+	}
+	if looksCorrupt(decodedImage{img: flat, originalLength: 50}) {
+		t.Error("small flat file was flagged")
+	}
+	if looksCorrupt(decodedImage{img: testImage(64, 64), originalLength: 5000}) {
+		t.Error("normal image was flagged")
+	}
+
+	withConfig(t, func(c *Config) { c.Image.UniformThreshold = 0 })
+	if looksCorrupt(decodedImage{img: flat, originalLength: 5000}) {
+		t.Error("flagged with the check turned off")
+	}
+}
+
+func TestLooksCorruptSamplesLargeImages(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.Image.UniformThreshold = 0.98
+		c.Image.UniformMinBytes = 100
+	})
+
+	// Grey only every 16th column, which a grid that steps too far in both
+	// directions would see and nothing else.
+	img := image.NewRGBA(image.Rect(0, 0, 2000, 2000))
+	for y := 0; y < 2000; y++ {
+		for x := 0; x < 2000; x++ {
+			c := color.RGBA{128, 128, 128, 255}
+			if x%16 != 0 {
+				c = color.RGBA{uint8(x), uint8(y), uint8(x + y), 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	if looksCorrupt(decodedImage{img: img, originalLength: 5000}) {
+		t.Error("a busy image was flagged as flat")
+	}
+}
+
+func TestCorruptDownloadRetried(t *testing.T) {
+	f, _ := newFakeInstance(t)
+	withConfig(t, func(c *Config) {
+		c.Image.UniformThreshold = 0.98
+		c.Image.UniformMinBytes = 1
+	})
+
+	corrupt := encodePNG(t, flatColor(64, 64, color.RGBA{128, 128, 128, 255}))
+	good := encodePNG(t, testImage(64, 64))
+
+	serve := func(path string, responses ...[]byte) string {
+		requests := 0
+		f.handle(http.MethodGet, path, func(w http.ResponseWriter, r *http.Request) {
+			data := responses[min(requests, len(responses)-1)]
+			requests++
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(data)
+		})
+		return f.url(path)
+	}
+
+	d, err := downloadAndDecode(serve("/img/flaky.png", corrupt, good), options{})
+	if err != nil {
+		t.Fatalf("second download wasn't used: %v", err)
+	}
+	if looksCorrupt(d) {
+		t.Error("got the corrupt decode")
+	}
+
+	if _, err := downloadAndDecode(serve("/img/broken.png", corrupt), options{}); !errors.Is(err, errCorruptImage) {
+		t.Errorf("always corrupt download gave %v, want errCorruptImage", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strings"
+)
+
+// albumSizes are the longest sides, in pixels, that "sizes" returns.
+var albumSizes = []int{512, 256, 128}
+
+// encodeSizes crunches an image once per album size, each labelled in its
+// alt text. Sizes the image is already no bigger than are skipped, leaving
+// just the one at its own size if it's smaller than all of them.
+func encodeSizes(original image.Image, opts options, originalLength int) ([]result, error) {
+	prepared, err := prepareImage(original, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	b := prepared.Bounds()
+	longest := max(b.Dx(), b.Dy())
+	var sizes []int
+	for _, size := range albumSizes {
+		if size < longest {
+			sizes = append(sizes, size)
+		}
+	}
+	if len(sizes) == 0 {
+		sizes = []int{longest}
+	}
+
+	var results []result
+	var labels []string
+	for _, size := range sizes {
+		res, err := compress(downscale(prepared, size), opts, originalLength)
+		if err != nil {
+			return nil, fmt.Errorf("%dpx: %w", size, err)
+		}
+		res.Description = fmt.Sprintf("The image crunched down to %dpx", size)
+		results = append(results, res)
+		labels = append(labels, fmt.Sprintf("%dpx", size))
+	}
+
+	results[0].addNote("Sizes: " + strings.Join(labels, ", ") + ".")
+	return results, nil
+}
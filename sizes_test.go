@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mattn/go-mastodon"
+)
+
+func TestEncodeSizes(t *testing.T) {
+	for _, tt := range []struct {
+		w, h    int
+		longest []int
+	}{
+		{800, 600, []int{512, 256, 128}},
+		{300, 400, []int{256, 128}},
+		{100, 50, []int{100}},
+	} {
+		results, err := encodeSizes(testImage(tt.w, tt.h), options{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != len(tt.longest) {
+			t.Errorf("%dx%d gave %d sizes, want %d", tt.w, tt.h, len(results), len(tt.longest))
+			continue
+		}
+		for i, res := range results {
+			img, _, err := decodeImage(res.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := img.Bounds()
+			if got := max(b.Dx(), b.Dy()); got != tt.longest[i] {
+				t.Errorf("%dx%d size %d is %dpx, want %dpx", tt.w, tt.h, i+1, got, tt.longest[i])
+			}
+			if want := fmt.Sprintf("%dpx", tt.longest[i]); !strings.Contains(res.Description, want) {
+				t.Errorf("size %d is described as %q, want it labelled %s", i+1, res.Description, want)
+			}
+		}
+	}
+}
+
+func TestSizesAlbumReply(t *testing.T) {
+	f, client := newFakeInstance(t)
+	withConfig(t, func(c *Config) { c.Reply.MaxReplies = 2 })
+
+	// Three images at three sizes each is one more than two replies hold.
+	notification := mention("1", "alice", "<p>@bot sizes</p>")
+	for i := 0; i < 3; i++ {
+		url := f.serveFile(fmt.Sprintf("/media/%d.png", i), "image/png", encodePNG(t, testImage(600, 400)))
+		notification.Status.MediaAttachments = append(notification.Status.MediaAttachments, mastodon.Attachment{Type: "image", URL: url})
+	}
+	handleMention(client, notification)
+
+	posts := f.posted()
+	if len(posts) != 2 {
+		t.Fatalf("posted %d replies, want 2", len(posts))
+	}
+	for i, post := range posts {
+		if n := len(post["media_ids[]"]); n != mediaPerReply {
+			t.Errorf("reply %d has %d images, want %d", i+1, n, mediaPerReply)
+		}
+	}
+	if got := len(f.uploaded()); got != 8 {
+		t.Errorf("uploaded %d images, want 8", got)
+	}
+	if !strings.Contains(posts[1].Get("status"), "left off the last 1") {
+		t.Errorf("last reply %q doesn't mention the size left off", posts[1].Get("status"))
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+const defaultStatsdAddr = "127.0.0.1:8125"
+
+// statsdSink pushes every emission to a statsd server over UDP as it happens.
+// Labels become DogStatsD-style tags, which the OpenTelemetry collector's
+// statsd receiver understands too.
+type statsdSink struct {
+	conn   net.Conn
+	prefix string
+}
+
+func newStatsdSink(addr, prefix string) (*statsdSink, error) {
+	if addr == "" {
+		addr = defaultStatsdAddr
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to statsd at %s: %w", addr, err)
+	}
+	log.Printf("Sending metrics to statsd at %s", addr)
+	return &statsdSink{conn: conn, prefix: prefix}, nil
+}
+
+func (s *statsdSink) inc(name string, labelPairs ...string) {
+	s.send(name, "1|c", labelPairs)
+}
+
+func (s *statsdSink) observe(name string, d time.Duration, labelPairs ...string) {
+	// statsd timers are in milliseconds, so the Prometheus-style unit suffix
+	// would be misleading.
+	name = strings.TrimSuffix(name, "_seconds")
+	s.send(name, fmt.Sprintf("%g|ms", float64(d)/float64(time.Millisecond)), labelPairs)
+}
+
+func (s *statsdSink) send(name, value string, labelPairs []string) {
+	line := s.prefix + name + ":" + value
+	if len(labelPairs) > 0 {
+		var tags []string
+		for i := 0; i+1 < len(labelPairs); i += 2 {
+			tags = append(tags, labelPairs[i]+":"+labelPairs[i+1])
+		}
+		line += "|#" + strings.Join(tags, ",")
+	}
+
+	// UDP is fire and forget; a missing collector shouldn't hold up replies.
+	if _, err := s.conn.Write([]byte(line)); err != nil {
+		log.Printf("Error sending metric to statsd: %v", err)
+	}
+}
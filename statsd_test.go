@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsdSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink, err := newStatsdSink(conn.LocalAddr().String(), "jpegbot.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.inc("jpegbot_posts_total")
+	sink.observe("jpegbot_decode_seconds", 1500*time.Microsecond, "format", "png")
+
+	want := []string{
+		"jpegbot.jpegbot_posts_total:1|c",
+		"jpegbot.jpegbot_decode:1.5|ms|#format:png",
+	}
+	buf := make([]byte, 512)
+	for _, w := range want {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("waiting for %q: %v", w, err)
+		}
+		if got := string(buf[:n]); got != w {
+			t.Errorf("received %q, want %q", got, w)
+		}
+	}
+}
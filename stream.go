@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+const (
+	processedCacheSize = 1000
+	maxReconnectDelay  = 5 * time.Minute
+	catchUpPageLimit   = 40
+	catchUpMaxPages    = 5
+
+	// minWatchdogTick keeps a tiny stall_timeout from spinning the watchdog
+	// (or, under 4ns, panicking the ticker).
+	minWatchdogTick = time.Millisecond
+)
+
+// processedCache remembers the most recent notification IDs we've handled so
+// the same notification is never processed twice, e.g. when it's seen both on
+// the stream and while catching up after a reconnect. If it has a path, it's
+// saved there after every change so it survives restarts.
+type processedCache struct {
+	mu    sync.Mutex
+	seen  map[mastodon.ID]bool
+	order []mastodon.ID
+	size  int
+	path  string
+}
+
+func newProcessedCache(size int) *processedCache {
+	return &processedCache{seen: make(map[mastodon.ID]bool), size: size}
+}
+
+// load reads previously handled IDs from path and keeps saving to it.
+func (c *processedCache) load(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var ids []mastodon.ID
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	for _, id := range ids {
+		c.add(id)
+	}
+	return nil
+}
+
+// contains reports whether id was already handled, without recording it.
+func (c *processedCache) contains(id mastodon.ID) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seen[id]
+}
+
+// markProcessed records id and reports whether it was new.
+func (c *processedCache) markProcessed(id mastodon.ID) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.seen[id] {
+		return false
+	}
+	c.add(id)
+
+	if c.path != "" {
+		if err := c.save(); err != nil {
+			log.Printf("Error saving processed notifications: %v", err)
+		}
+	}
+	return true
+}
+
+func (c *processedCache) add(id mastodon.ID) {
+	c.seen[id] = true
+	c.order = append(c.order, id)
+	if len(c.order) > c.size {
+		delete(c.seen, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+func (c *processedCache) save() error {
+	data, err := json.Marshal(c.order)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+var processed = newProcessedCache(processedCacheSize)
+
+// lastEventID is the ID of the newest notification seen. The WebSocket
+// streaming API doesn't support resuming from a Last-Event-ID, so after a
+// reconnect we page through the notifications newer than it instead.
+var lastEventID mastodon.ID
+
+// lastEventMu guards lastEventID, which the watchdog reads from its own
+// goroutine.
+var lastEventMu sync.Mutex
+
+// noteEventID advances lastEventID to id if it's newer.
+func noteEventID(id mastodon.ID) {
+	lastEventMu.Lock()
+	defer lastEventMu.Unlock()
+	if newerID(id, lastEventID) {
+		lastEventID = id
+	}
+}
+
+func latestEventID() mastodon.ID {
+	lastEventMu.Lock()
+	defer lastEventMu.Unlock()
+	return lastEventID
+}
+
+// watchdog notices a stream that has gone quiet without closing, as happens
+// when something between us and the instance drops the connection silently.
+type watchdog struct {
+	mu           sync.Mutex
+	lastActivity time.Time
+}
+
+func (w *watchdog) touch() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastActivity = time.Now()
+}
+
+func (w *watchdog) idle() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return time.Since(w.lastActivity)
+}
+
+// watch checks on the stream once it has been idle for longer than timeout,
+// and calls stall if healthy says it has stopped delivering. It stops when
+// ctx is done.
+//
+// The instance's heartbeats would be the natural sign of life, but the
+// WebSocket client swallows them, so a quiet stream is instead checked by
+// asking the API whether anything arrived that the stream didn't deliver.
+func (w *watchdog) watch(ctx context.Context, timeout time.Duration, healthy func() bool, stall func()) {
+	ticker := time.NewTicker(max(timeout/4, minWatchdogTick))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			idle := w.idle()
+			if idle <= timeout {
+				continue
+			}
+			if healthy() {
+				w.touch()
+				continue
+			}
+			log.Printf("Stream has been silent for %v and missed notifications, reconnecting", idle.Round(time.Second))
+			stall()
+			return
+		}
+	}
+}
+
+// streamCaughtUp reports whether the stream has delivered the newest
+// notification the API knows about. It's a cheap request, and the only way
+// to tell a quiet stream from a dead one. If the API can't be reached
+// either, the stream is assumed dead too.
+func streamCaughtUp(client *mastodon.Client) bool {
+	notifications, err := client.GetNotifications(ctx, &mastodon.Pagination{Limit: 1})
+	if err != nil {
+		log.Printf("Error checking on the stream: %v", err)
+		return false
+	}
+	if len(notifications) == 0 {
+		return true
+	}
+	if latestEventID() == "" {
+		// Nothing seen yet to compare against, so start from here.
+		noteEventID(notifications[0].ID)
+		return true
+	}
+	return !newerID(notifications[0].ID, latestEventID())
+}
+
+// runStream listens for notifications forever, reconnecting with a backoff
+// whenever the stream gives up or the watchdog decides it has stalled.
+func runStream(client *mastodon.Client) {
+	ws := client.NewWSClient()
+	delay := time.Second
+	dog := &watchdog{}
+
+	startupCatchUp(client)
+
+	for {
+		streamCtx, cancel := context.WithCancel(ctx)
+		events, err := ws.StreamingWSUser(streamCtx)
+		if err != nil {
+			log.Printf("Error connecting to streaming API: %v", err)
+		} else {
+			log.Println("Connected to streaming API")
+			dog.touch()
+			if timeout := config.Bot.StallTimeout; timeout > 0 {
+				go dog.watch(streamCtx, timeout, func() bool { return streamCaughtUp(client) }, cancel)
+			}
+			catchUp(client)
+			for event := range events {
+				if handleEvent(client, event) {
+					delay = time.Second
+					dog.touch()
+				}
+			}
+		}
+		cancel()
+
+		log.Printf("Stream closed, reconnecting in %v", delay)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// handleEvent processes one streaming event and reports whether it was a
+// healthy (non-error) event, which counts as activity for the watchdog.
+func handleEvent(client *mastodon.Client, event mastodon.Event) bool {
+	switch e := event.(type) {
+	case *mastodon.NotificationEvent:
+		handleNotification(client, e.Notification)
+	case *mastodon.UpdateEditEvent:
+		// Edits only stream for statuses on the home timeline, so this
+		// only catches edits from accounts the bot follows. Everyone
+		// else's are picked up by fetching the mention again once it
+		// settles.
+		if window := config.Bot.EditDebounce; window > 0 && edits.update(e.Status, window) {
+			log.Printf("Mention %s was edited, waiting for it to settle", e.Status.ID)
+		}
+	case *mastodon.UpdateEvent, *mastodon.DeleteEvent:
+		// Nothing to do, but they show the stream is alive.
+	case *mastodon.ErrorEvent:
+		// The streaming client reconnects on its own after read errors, so
+		// anything that arrived in between has to be fetched separately.
+		log.Printf("Streaming error: %v", e.Err)
+		catchUp(client)
+		return false
+	}
+	return true
+}
+
+func handleNotification(client *mastodon.Client, notification *mastodon.Notification) {
+	noteEventID(notification.ID)
+
+	// Held back mentions are only marked processed once they're handled,
+	// so one still waiting when the bot restarts is caught up on instead of
+	// lost. Repeats before then land on the same status and collapse.
+	if window := config.Bot.EditDebounce; window > 0 && notification.Type == "mention" && notification.Status != nil {
+		if processed.contains(notification.ID) {
+			return
+		}
+		edits.debounce(notification, window, func(latest *mastodon.Notification) {
+			if !processed.markProcessed(latest.ID) {
+				return
+			}
+			submitNotification(client, refetchStatus(client, latest))
+		})
+		return
+	}
+
+	if !processed.markProcessed(notification.ID) {
+		return
+	}
+	submitNotification(client, notification)
+}
+
+func submitNotification(client *mastodon.Client, notification *mastodon.Notification) {
+	pools.get(client).submit(func() {
+		switch notification.Type {
+		case "mention":
+			handleMention(client, notification)
+		case "follow":
+			handleFollow(client, notification)
+		}
+	})
+}
+
+// refetchStatus swaps in the current version of a notification's status, so
+// edits made while it was held back are what gets handled. If that fails
+// the status is used as it arrived.
+func refetchStatus(client *mastodon.Client, notification *mastodon.Notification) *mastodon.Notification {
+	status, err := client.GetStatus(ctx, notification.Status.ID)
+	if err != nil {
+		log.Printf("Error fetching the latest version of %s: %v", notification.Status.ID, err)
+		return notification
+	}
+	latest := *notification
+	latest.Status = status
+	return &latest
+}
+
+// newerID reports whether a is a later ID than b. Mastodon IDs are numeric
+// strings, so a longer ID is always the newer one.
+func newerID(a, b mastodon.ID) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
+
+// startupCatchUp handles recent mentions that arrived while the bot was
+// down. It looks at up to catch_up_count notifications, skipping any older
+// than catch_up_max_age and any already handled before the restart.
+func startupCatchUp(client *mastodon.Client) {
+	count := config.Bot.CatchUpCount
+	if count <= 0 {
+		return
+	}
+
+	notifications, err := client.GetNotifications(ctx, &mastodon.Pagination{Limit: int64(count)})
+	if err != nil {
+		log.Printf("Error fetching notifications to catch up on: %v", err)
+		return
+	}
+
+	maxAge := config.Bot.CatchUpMaxAge
+	for i := len(notifications) - 1; i >= 0; i-- {
+		notification := notifications[i]
+		noteEventID(notification.ID)
+		if notification.Type != "mention" {
+			continue
+		}
+		if maxAge > 0 && time.Since(notification.CreatedAt) > maxAge {
+			continue
+		}
+		handleNotification(client, notification)
+	}
+}
+
+// catchUp processes notifications that arrived after lastEventID, oldest
+// first. It does nothing until at least one notification has been seen.
+func catchUp(client *mastodon.Client) {
+	if latestEventID() == "" {
+		return
+	}
+
+	for page := 0; page < catchUpMaxPages; page++ {
+		notifications, err := client.GetNotifications(ctx, &mastodon.Pagination{MinID: latestEventID(), Limit: catchUpPageLimit})
+		if err != nil {
+			log.Printf("Error catching up on notifications: %v", err)
+			return
+		}
+		if len(notifications) == 0 {
+			return
+		}
+
+		log.Printf("Catching up on %d missed notifications", len(notifications))
+		for i := len(notifications) - 1; i >= 0; i-- {
+			handleNotification(client, notifications[i])
+		}
+
+		if len(notifications) < catchUpPageLimit {
+			return
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// withLastEventID starts a test from id as the newest notification seen.
+func withLastEventID(t *testing.T, id mastodon.ID) {
+	t.Helper()
+	saved := latestEventID()
+	t.Cleanup(func() {
+		lastEventMu.Lock()
+		lastEventID = saved
+		lastEventMu.Unlock()
+	})
+	lastEventMu.Lock()
+	lastEventID = id
+	lastEventMu.Unlock()
+}
+
+func TestCatchUpResumesFromLastEventID(t *testing.T) {
+	f, client := newFakeInstance(t)
+	withLastEventID(t, "105")
+
+	var minIDs []string
+	f.handle(http.MethodGet, "/api/v1/notifications", func(w http.ResponseWriter, r *http.Request) {
+		minIDs = append(minIDs, r.URL.Query().Get("min_id"))
+		if len(minIDs) > 1 {
+			writeJSON(w, []*mastodon.Notification{})
+			return
+		}
+		writeJSON(w, []*mastodon.Notification{
+			{ID: "107", Type: "follow", Account: mastodon.Account{Acct: "b"}},
+			{ID: "106", Type: "follow", Account: mastodon.Account{Acct: "a"}},
+		})
+	})
+
+	catchUp(client)
+
+	if len(minIDs) == 0 || minIDs[0] != "105" {
+		t.Fatalf("catch-up asked for notifications after %q, want 105", minIDs)
+	}
+	if got := latestEventID(); got != "107" {
+		t.Errorf("last event ID is %s after catching up, want 107", got)
+	}
+	for _, id := range []mastodon.ID{"106", "107"} {
+		if !processed.contains(id) {
+			t.Errorf("missed notification %s wasn't handled", id)
+		}
+	}
+}
+
+func TestCatchUpWaitsForFirstEvent(t *testing.T) {
+	f, client := newFakeInstance(t)
+	withLastEventID(t, "")
+
+	asked := false
+	f.handle(http.MethodGet, "/api/v1/notifications", func(w http.ResponseWriter, r *http.Request) {
+		asked = true
+		writeJSON(w, []*mastodon.Notification{})
+	})
+
+	catchUp(client)
+	if asked {
+		t.Error("catch-up ran without a last event ID to resume from")
+	}
+}
+
+func TestStartupCatchUp(t *testing.T) {
+	f, client := newFakeInstance(t)
+	withLastEventID(t, "")
+	withConfig(t, func(c *Config) {
+		c.Bot.CatchUpCount = 10
+		c.Bot.CatchUpMaxAge = time.Hour
+	})
+
+	handled := mention("1", "alice", "<p>@bot</p>")
+	stale := mention("2", "bob", "<p>@bot</p>")
+	fresh := mention("3", "carol", "<p>@bot</p>")
+	handled.CreatedAt = time.Now().Add(-time.Minute)
+	stale.CreatedAt = time.Now().Add(-2 * time.Hour)
+	fresh.CreatedAt = time.Now().Add(-time.Minute)
+	processed.markProcessed(handled.ID)
+
+	f.handle(http.MethodGet, "/api/v1/notifications", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("limit") != "10" {
+			t.Errorf("asked for %s notifications, want catch_up_count", r.URL.Query().Get("limit"))
+		}
+		writeJSON(w, []*mastodon.Notification{fresh, stale, handled})
+	})
+
+	startupCatchUp(client)
+
+	waitFor(t, "the missed mention's reply", func() bool { return len(f.posted()) > 0 })
+	time.Sleep(50 * time.Millisecond)
+	posts := f.posted()
+	if len(posts) != 1 || posts[0].Get("in_reply_to_id") != "3" {
+		t.Errorf("replied to %v, want only the fresh mention", posts)
+	}
+	if got := latestEventID(); got != "n3" {
+		t.Errorf("last event ID is %s, want the newest notification", got)
+	}
+}
+
+func TestWatchdogHealthyProbeKeepsStream(t *testing.T) {
+	dog := &watchdog{}
+	dog.touch()
+
+	watchCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var probes atomic.Int32
+	stalled := make(chan struct{})
+	go dog.watch(watchCtx, 20*time.Millisecond, func() bool {
+		probes.Add(1)
+		return true
+	}, func() { close(stalled) })
+
+	select {
+	case <-stalled:
+		t.Fatal("reconnected although the API said the stream was caught up")
+	case <-time.After(150 * time.Millisecond):
+	}
+	if probes.Load() == 0 {
+		t.Error("a quiet stream was never checked on")
+	}
+	if dog.idle() > 100*time.Millisecond {
+		t.Error("a healthy probe didn't count as activity")
+	}
+}
+
+func TestWatchdogStallsWhenBehind(t *testing.T) {
+	dog := &watchdog{}
+	dog.touch()
+
+	stalled := make(chan struct{})
+	go dog.watch(context.Background(), 20*time.Millisecond, func() bool { return false }, func() { close(stalled) })
+
+	select {
+	case <-stalled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a stream that missed notifications wasn't reconnected")
+	}
+}
+
+func TestWatchdogTinyTimeout(t *testing.T) {
+	dog := &watchdog{}
+	dog.touch()
+
+	// Under 4ns the tick would be zero, which NewTicker panics on.
+	stalled := make(chan struct{})
+	go dog.watch(context.Background(), 3*time.Nanosecond, func() bool { return false }, func() { close(stalled) })
+
+	select {
+	case <-stalled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a watchdog with a 3ns timeout never checked on the stream")
+	}
+}
+
+func TestStreamCaughtUp(t *testing.T) {
+	f, client := newFakeInstance(t)
+	newest := mastodon.ID("200")
+	fail := false
+	f.handle(http.MethodGet, "/api/v1/notifications", func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, `{"error":"down"}`, http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, []*mastodon.Notification{{ID: newest, Type: "favourite"}})
+	})
+
+	withLastEventID(t, "")
+	if !streamCaughtUp(client) || latestEventID() != "200" {
+		t.Errorf("with nothing seen yet, the newest notification should become the baseline")
+	}
+
+	if !streamCaughtUp(client) {
+		t.Error("stream that delivered the newest notification counted as behind")
+	}
+
+	newest = "201"
+	if streamCaughtUp(client) {
+		t.Error("stream that missed a notification counted as caught up")
+	}
+
+	fail = true
+	if streamCaughtUp(client) {
+		t.Error("unreachable API counted as caught up")
+	}
+}
+
+func TestKeepaliveEventsCountAsActivity(t *testing.T) {
+	f, client := newFakeInstance(t)
+	withLastEventID(t, "100")
+
+	for _, event := range []mastodon.Event{
+		&mastodon.UpdateEvent{Status: &mastodon.Status{ID: "5"}},
+		&mastodon.DeleteEvent{ID: "6"},
+	} {
+		if !handleEvent(client, event) {
+			t.Errorf("%T didn't count as activity", event)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if posts := f.posted(); len(posts) != 0 {
+		t.Errorf("non-notification events were processed: %v", posts)
+	}
+	if latestEventID() != "100" {
+		t.Error("non-notification events moved the last event ID")
+	}
+}
+
+func TestEditDebounceCollapsesEvents(t *testing.T) {
+	f, client := newFakeInstance(t)
+	withLastEventID(t, "")
+	withConfig(t, func(c *Config) { c.Bot.EditDebounce = 100 * time.Millisecond })
+
+	notification := imageMention(t, f, "1", "<p>@bot</p>", 1)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		handleNotification(client, notification)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// An edit restarts the wait, and what's handled is the status as it is
+	// once that's over.
+	edited := *notification.Status
+	edited.Content = "<p>@bot quality 30</p>"
+	handleEvent(client, &mastodon.UpdateEditEvent{Status: &edited})
+	final := edited
+	final.Content = "<p>@bot quality 40</p>"
+	f.addStatus(&final)
+
+	waitFor(t, "the debounced reply", func() bool { return len(f.posted()) > 0 })
+	if waited := time.Since(start); waited < 160*time.Millisecond {
+		t.Errorf("replied after %v, before the edit's wait was over", waited)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if posts := f.posted(); len(posts) != 1 {
+		t.Errorf("posted %d replies for one mention sent three times and edited, want 1", len(posts))
+	}
+	if q, _ := estimateJPEGQuality(f.uploaded()[0]); q < 39 || q > 41 {
+		t.Errorf("crunched at quality %d, want the final version's 40", q)
+	}
+	if !processed.contains(notification.ID) {
+		t.Error("the mention wasn't marked as handled")
+	}
+
+	// Once it's handled, the same notification is ignored.
+	handleNotification(client, notification)
+	time.Sleep(200 * time.Millisecond)
+	if posts := f.posted(); len(posts) != 1 {
+		t.Errorf("a repeat after handling posted again: %d replies", len(posts))
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/mattn/go-mastodon"
+)
+
+const (
+	defaultWorkers = 1
+	jobQueueSize   = 100
+)
+
+// accountPool runs one account's jobs on workers of its own, so an account
+// whose instance is slow or down only holds up its own jobs. The first
+// worker is reserved for the account; any others take a slot from the
+// shared global cap while they run, so a stalled account can tie up at
+// most its extra workers and never another account's reserved one.
+type accountPool struct {
+	jobs   chan func()
+	global chan struct{} // nil when there's no global cap
+
+	// handoff passes a job from a shared worker still waiting for a global
+	// slot to the reserved worker, if that's free.
+	handoff chan func()
+}
+
+func newAccountPool(workers int, global chan struct{}) *accountPool {
+	p := &accountPool{jobs: make(chan func(), jobQueueSize), global: global, handoff: make(chan func())}
+	go p.runReserved()
+	for i := 1; i < workers; i++ {
+		if global == nil {
+			go p.runReserved()
+		} else {
+			go p.runShared()
+		}
+	}
+	return p
+}
+
+func (p *accountPool) runReserved() {
+	for {
+		select {
+		case job := <-p.jobs:
+			job()
+		case job := <-p.handoff:
+			job()
+		}
+	}
+}
+
+func (p *accountPool) runShared() {
+	for job := range p.jobs {
+		select {
+		case p.global <- struct{}{}:
+			job()
+			<-p.global
+		case p.handoff <- job:
+		}
+	}
+}
+
+// submit queues a job, blocking only if this account's queue is full.
+func (p *accountPool) submit(job func()) {
+	p.jobs <- job
+}
+
+// poolRegistry hands out one pool per account, keyed by its client.
+type poolRegistry struct {
+	mu     sync.Mutex
+	pools  map[*mastodon.Client]*accountPool
+	global chan struct{}
+}
+
+var pools = &poolRegistry{pools: make(map[*mastodon.Client]*accountPool)}
+
+func (r *poolRegistry) get(client *mastodon.Client) *accountPool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.global == nil && config.Bot.MaxWorkers > 0 {
+		r.global = make(chan struct{}, config.Bot.MaxWorkers)
+	}
+
+	p, ok := r.pools[client]
+	if !ok {
+		workers := config.Bot.Workers
+		if workers <= 0 {
+			workers = defaultWorkers
+		}
+		p = newAccountPool(workers, r.global)
+		r.pools[client] = p
+	}
+	return p
+}
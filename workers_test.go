@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+func TestStalledAccountDoesntBlockOthers(t *testing.T) {
+	pools := &poolRegistry{pools: make(map[*mastodon.Client]*accountPool)}
+	withConfig(t, func(c *Config) {
+		c.Bot.Workers = 2
+		c.Bot.MaxWorkers = 1
+	})
+
+	stalled := mastodon.NewClient(&mastodon.Config{Server: "https://stalled.example"})
+	healthy := mastodon.NewClient(&mastodon.Config{Server: "https://healthy.example"})
+
+	// Both of the stalled account's workers get stuck, and its shared one
+	// holds the only global slot.
+	release := make(chan struct{})
+	stuck := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		pools.get(stalled).submit(func() {
+			stuck <- struct{}{}
+			<-release
+		})
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-stuck:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the stalled account's jobs didn't start")
+		}
+	}
+
+	done := make(chan struct{})
+	pools.get(healthy).submit(func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the healthy account's job waited on the stalled account")
+	}
+	close(release)
+}
+
+func TestGlobalWorkerCap(t *testing.T) {
+	pools := &poolRegistry{pools: make(map[*mastodon.Client]*accountPool)}
+	withConfig(t, func(c *Config) {
+		c.Bot.Workers = 3
+		c.Bot.MaxWorkers = 1
+	})
+	client := mastodon.NewClient(&mastodon.Config{Server: "https://busy.example"})
+
+	// With one shared slot, only the reserved worker and one other can run
+	// at once.
+	release := make(chan struct{})
+	running := make(chan struct{}, 3)
+	for i := 0; i < 3; i++ {
+		pools.get(client).submit(func() {
+			running <- struct{}{}
+			<-release
+		})
+	}
+	for i := 0; i < 2; i++ {
+		<-running
+	}
+	select {
+	case <-running:
+		t.Error("a third job ran past the global cap")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+}